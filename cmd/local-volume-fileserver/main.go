@@ -1,14 +1,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/filesystem"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/replicatedhq/local-volume-provider/pkg/k8sutil"
 	"github.com/replicatedhq/local-volume-provider/pkg/plugin"
 	"github.com/replicatedhq/local-volume-provider/pkg/version"
 )
@@ -31,6 +35,12 @@ func main() {
 		log.Fatalf("Could not find mountpoint: %s", mountPoint)
 	}
 
+	clientset, err := k8sutil.GetClientset()
+	if err != nil {
+		log.Fatalf("Could not get kubernetes clientset: %v", err)
+	}
+	keys := plugin.NewKeyring(clientset, os.Getenv("VELERO_NAMESPACE"))
+
 	// livez endpoint
 	app.Get("/livez", func(c *fiber.Ctx) error {
 		return c.SendString("Hello, World!")
@@ -52,10 +62,28 @@ func main() {
 		return c.Next()
 	})
 
-	// static file serving middleware
-	app.Use(filesystem.New(filesystem.Config{
-		Root: http.Dir(mountPoint),
-	}))
+	// objects are served the same way the plugin reads them, decoded and verified
+	app.Get("/*", func(c *fiber.Ctx) error {
+		objectPath, err := url.PathUnescape(c.Path())
+		if err != nil {
+			return c.SendStatus(http.StatusBadRequest)
+		}
+
+		object, err := plugin.OpenObject(mountPoint, objectPath, keys)
+		if err != nil {
+			var invalidKeyErr *plugin.InvalidKeyError
+			if os.IsNotExist(err) || errors.As(err, &invalidKeyErr) {
+				return c.SendStatus(http.StatusNotFound)
+			}
+			log.Printf("Failed to open %s: %v", objectPath, err)
+			return c.SendStatus(http.StatusInternalServerError)
+		}
+
+		if ext := filepath.Ext(objectPath); ext != "" {
+			c.Type(strings.TrimPrefix(ext, "."))
+		}
+		return c.SendStream(object)
+	})
 
 	app.Listen(":3000")
 }
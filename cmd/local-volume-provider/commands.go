@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/replicatedhq/local-volume-provider/pkg/k8sutil"
+	"github.com/replicatedhq/local-volume-provider/pkg/plugin"
+	"github.com/sirupsen/logrus"
+)
+
+// commands are run instead of the plugin server when they are named as the first argument,
+// e.g. with kubectl exec in the Velero pod, which has the volumes mounted.
+var commands = map[string]func(args []string) error{
+	"legal-hold": legalHoldCommand,
+	"mirror":     mirrorCommand,
+	"trash":      trashCommand,
+	"usage":      usageCommand,
+	"versions":   versionsCommand,
+}
+
+const legalHoldUsage = `usage: local-volume-provider legal-hold set <bucket> <prefix> [reason]
+       local-volume-provider legal-hold clear <bucket> <prefix>`
+
+// legalHoldCommand places or clears a legal hold on a prefix of a bucket mounted in this pod.
+func legalHoldCommand(args []string) error {
+	if len(args) < 3 {
+		return errors.New(legalHoldUsage)
+	}
+	action, bucket, prefix := args[0], args[1], args[2]
+
+	switch action {
+	case "set":
+		if err := plugin.SetLegalHold(bucket, prefix, strings.Join(args[3:], " ")); err != nil {
+			return err
+		}
+		fmt.Printf("Placed a legal hold on %s in %s\n", prefix, bucket)
+	case "clear":
+		if err := plugin.ClearLegalHold(bucket, prefix); err != nil {
+			return err
+		}
+		fmt.Printf("Cleared the legal hold on %s in %s\n", prefix, bucket)
+	default:
+		return errors.New(legalHoldUsage)
+	}
+	return nil
+}
+
+const trashUsage = `usage: local-volume-provider trash list <bucket>
+       local-volume-provider trash restore <bucket> <prefix>`
+
+// trashCommand lists the backups in the trash of a bucket mounted in this pod, or restores objects from it.
+func trashCommand(args []string) error {
+	if len(args) < 2 {
+		return errors.New(trashUsage)
+	}
+	action, bucket := args[0], args[1]
+
+	switch action {
+	case "list":
+		objects, err := plugin.ListTrash(bucket)
+		if err != nil {
+			return err
+		}
+
+		// Group the objects by backup, most recently deleted first
+		var prefixes []string
+		counts := make(map[string]int)
+		deletedAt := make(map[string]time.Time)
+		for _, object := range objects {
+			prefix := backupPrefix(object.Key)
+			if _, ok := counts[prefix]; !ok {
+				prefixes = append(prefixes, prefix)
+				deletedAt[prefix] = object.DeletedAt
+			}
+			counts[prefix]++
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PREFIX\tOBJECTS\tDELETED")
+		for _, prefix := range prefixes {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", prefix, counts[prefix], deletedAt[prefix].Format(time.RFC3339))
+		}
+		return w.Flush()
+	case "restore":
+		if len(args) < 3 {
+			return errors.New(trashUsage)
+		}
+		restored, err := plugin.RestoreFromTrash(bucket, args[2])
+		for _, key := range restored {
+			fmt.Printf("Restored %s\n", key)
+		}
+		if err != nil {
+			return err
+		}
+		if len(restored) == 0 {
+			return fmt.Errorf("nothing to restore under %s", args[2])
+		}
+	default:
+		return errors.New(trashUsage)
+	}
+	return nil
+}
+
+// backupPrefix returns the prefix of the backup a key belongs to, e.g. "velero/backups/b1/",
+// or the directory of the key if it doesn't belong to a backup.
+func backupPrefix(key string) string {
+	parts := strings.Split(key, "/")
+	for i := 0; i < len(parts)-2; i++ {
+		if parts[i] == "backups" {
+			return strings.Join(parts[:i+2], "/") + "/"
+		}
+	}
+	return path.Dir(key) + "/"
+}
+
+const mirrorUsage = `usage: local-volume-provider mirror check <bucket> <mirror bucket> [prefix]
+       local-volume-provider mirror repair <bucket> <mirror bucket> [prefix]`
+
+// mirrorCommand reports the objects whose copies differ between a bucket and its mirror, and optionally repairs them.
+func mirrorCommand(args []string) error {
+	if len(args) < 3 {
+		return errors.New(mirrorUsage)
+	}
+	action, bucket, mirrorBucket := args[0], args[1], args[2]
+	prefix := ""
+	if len(args) > 3 {
+		prefix = args[3]
+	}
+	if action != "check" && action != "repair" {
+		return errors.New(mirrorUsage)
+	}
+
+	clientset, err := k8sutil.GetClientset()
+	if err != nil {
+		return err
+	}
+	keys := plugin.NewKeyring(clientset, os.Getenv("VELERO_NAMESPACE"))
+
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	divergences, err := plugin.RepairMirror(bucket, mirrorBucket, prefix, action == "repair", keys, log)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tREPAIRED\tREASON")
+	for _, divergence := range divergences {
+		fmt.Fprintf(w, "%s\t%t\t%s\n", divergence.Key, divergence.Repaired, divergence.Reason)
+	}
+	w.Flush()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d objects differ between %s and %s\n", len(divergences), bucket, mirrorBucket)
+	return nil
+}
+
+const versionsUsage = `usage: local-volume-provider versions list <bucket> <key>
+       local-volume-provider versions restore <bucket> <key> <version>`
+
+// versionsCommand lists the previous versions of an object in a bucket mounted in this pod, or restores one of them.
+func versionsCommand(args []string) error {
+	if len(args) < 3 {
+		return errors.New(versionsUsage)
+	}
+	action, bucket, key := args[0], args[1], args[2]
+
+	switch action {
+	case "list":
+		versions, err := plugin.ListVersions(bucket, key)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tSIZE\tMODIFIED")
+		for _, version := range versions {
+			fmt.Fprintf(w, "%d\t%d\t%s\n", version.Version, version.Size, version.LastModified.Format(time.RFC3339))
+		}
+		return w.Flush()
+	case "restore":
+		if len(args) < 4 {
+			return errors.New(versionsUsage)
+		}
+		version, err := strconv.Atoi(args[3])
+		if err != nil {
+			return errors.New(versionsUsage)
+		}
+		if err := plugin.RestoreVersion(bucket, key, version); err != nil {
+			return err
+		}
+		fmt.Printf("Restored version %d of %s in %s\n", version, key, bucket)
+	default:
+		return errors.New(versionsUsage)
+	}
+	return nil
+}
+
+const usageUsage = `usage: local-volume-provider usage <bucket>`
+
+// usageCommand reports the space used by a bucket mounted in this pod.
+func usageCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New(usageUsage)
+	}
+	usage, err := plugin.BucketUsage(args[0])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OBJECTS\tLOGICAL BYTES\tPHYSICAL BYTES")
+	fmt.Fprintf(w, "%d\t%d\t%d\n", usage.Objects, usage.LogicalBytes, usage.PhysicalBytes)
+	return w.Flush()
+}
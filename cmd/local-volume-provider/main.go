@@ -17,11 +17,22 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
 	veleroplugin.NewServer().
 		BindFlags(pflag.CommandLine).
 		RegisterObjectStore("replicated.com/hostpath", newHostPathObjectStorePlugin).
 		RegisterObjectStore("replicated.com/nfs", newNFSObjectStorePlugin).
 		RegisterObjectStore("replicated.com/pvc", newPVCObjectStorePlugin).
+		RegisterObjectStore("replicated.com/csi", newCSIObjectStorePlugin).
 		Serve()
 }
 
@@ -36,3 +47,7 @@ func newNFSObjectStorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 func newPVCObjectStorePlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return plugin.NewLocalVolumeObjectStore(logger, plugin.PVC), nil
 }
+
+func newCSIObjectStorePlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return plugin.NewLocalVolumeObjectStore(logger, plugin.CSI), nil
+}
@@ -0,0 +1,292 @@
+package plugin
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultCacheTTL is how long cached listings and objects are used for, as long as the volume shows
+// no changes to them, unless the "cacheTTL" key is set in the plugin config map.
+const defaultCacheTTL = 5 * time.Minute
+
+// maxCachedObjectSize is the largest object that is cached, which covers the metadata files
+// Velero reads for every backup on each backup sync but not the backups themselves.
+const maxCachedObjectSize = 1024 * 1024
+
+// cacheOpts configure the cache of listings and small objects, from the plugin config map.
+type cacheOpts struct {
+	// size is the most bytes held in the cache, 0 disables it.
+	size int64
+	ttl  time.Duration
+}
+
+// parseCacheOpts validates the cache settings in the plugin config map.
+func parseCacheOpts(data map[string]string) (cacheOpts, error) {
+	size, err := parseBytes("cacheSize", data["cacheSize"])
+	if err != nil {
+		return cacheOpts{}, err
+	}
+	opts := cacheOpts{size: size, ttl: defaultCacheTTL}
+	if s := data["cacheTTL"]; s != "" {
+		opts.ttl, err = time.ParseDuration(s)
+		if err != nil || opts.ttl <= 0 {
+			return cacheOpts{}, errors.Errorf("cacheTTL must be a duration such as 5m, got %q", s)
+		}
+	}
+	return opts, nil
+}
+
+// fileVersion identifies the state of a file or directory, so that changes made to the volume
+// by other pods can be told apart from what is cached.
+type fileVersion struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+	ino     uint64
+}
+
+func statVersion(path string) (fileVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fileVersion{}, nil
+		}
+		return fileVersion{}, err
+	}
+	version := fileVersion{exists: true, modTime: info.ModTime(), size: info.Size()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		version.ino = stat.Ino
+	}
+	return version, nil
+}
+
+// fileVersions records the versions of the directories read for a listing, which it is valid for
+// until any of them changes. A nil fileVersions records nothing.
+type fileVersions map[string]fileVersion
+
+// record notes the version of the directory at path. It must be called before the directory is read,
+// so that a change made while reading it is noticed.
+func (v fileVersions) record(path string) error {
+	if v == nil {
+		return nil
+	}
+	version, err := statVersion(path)
+	if err != nil {
+		return err
+	}
+	v[path] = version
+	return nil
+}
+
+// unchanged returns truthy if none of the recorded files or directories have changed.
+func (v fileVersions) unchanged() bool {
+	for path, recorded := range v {
+		version, err := statVersion(path)
+		if err != nil || version != recorded {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheEntry is a listing or the contents of an object.
+type cacheEntry struct {
+	key      string
+	listing  []string
+	data     []byte
+	deps     fileVersions
+	cachedAt time.Time
+	size     int64
+}
+
+// readCache holds listings and small objects in memory, so that backup syncs don't read the
+// metadata of every backup from slow volumes each time.
+type readCache struct {
+	mu      sync.Mutex
+	opts    cacheOpts
+	entries map[string]*list.Element
+	lru     *list.List
+	used    int64
+}
+
+// sharedCache holds the cached listings and small objects of every bucket, up to the size it is configured with.
+var sharedCache = newReadCache()
+
+// newReadCache returns a cache that is disabled until it is configured.
+func newReadCache() *readCache {
+	return &readCache{entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// configure applies opts, emptying the cache if it's disabled.
+func (c *readCache) configure(opts cacheOpts) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opts = opts
+	c.evict()
+}
+
+func (c *readCache) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opts.size > 0
+}
+
+// get returns the entry for key if it is still valid.
+func (c *readCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	expired := time.Since(entry.cachedAt) >= c.opts.ttl
+	c.mu.Unlock()
+
+	// The volume is checked without holding the lock, since it can be slow
+	if expired || !entry.deps.unchanged() {
+		c.remove(key, entry)
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+	}
+	return entry
+}
+
+// put adds an entry, evicting the least recently used entries to make room for it.
+func (c *readCache) put(entry *cacheEntry) {
+	entry.cachedAt = time.Now()
+	entry.size = int64(len(entry.key) + len(entry.data))
+	for _, s := range entry.listing {
+		entry.size += int64(len(s))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry.size > c.opts.size {
+		return
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.used -= elem.Value.(*cacheEntry).size
+		c.lru.Remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.used += entry.size
+	c.evict()
+}
+
+// evict removes the least recently used entries until the cache fits its size.
+func (c *readCache) evict() {
+	for c.used > c.opts.size && c.lru.Len() > 0 {
+		entry := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, entry.key)
+		c.used -= entry.size
+	}
+}
+
+// remove removes the entry for key, unless it has been replaced by a newer one.
+func (c *readCache) remove(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok || (entry != nil && elem.Value != entry) {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, key)
+	c.used -= elem.Value.(*cacheEntry).size
+}
+
+// invalidate removes the object at path in the bucket at bucketPath from the cache,
+// along with every listing of the bucket, once the object is written or deleted.
+func (c *readCache) invalidate(bucketPath, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.entries {
+		if key == objectCacheKey(path) || strings.HasPrefix(key, listingCacheKey(bucketPath, "")) {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+			c.used -= elem.Value.(*cacheEntry).size
+		}
+	}
+}
+
+func objectCacheKey(path string) string {
+	return "object\x00" + path
+}
+
+// listingCacheKey identifies a listing of the bucket at bucketPath, e.g. of the objects or common prefixes under a prefix.
+func listingCacheKey(bucketPath, listing string) string {
+	return "listing\x00" + bucketPath + "\x00" + listing
+}
+
+// listing returns the cached listing for key, or calls fill to list it. fill records the directories
+// it reads in deps.
+func (c *readCache) listing(key string, fill func(deps fileVersions) ([]string, error)) ([]string, error) {
+	if !c.enabled() {
+		return fill(nil)
+	}
+	if entry := c.get(key); entry != nil {
+		return append([]string{}, entry.listing...), nil
+	}
+
+	deps := fileVersions{}
+	listing, err := fill(deps)
+	if err != nil {
+		return nil, err
+	}
+	c.put(&cacheEntry{key: key, listing: append([]string{}, listing...), deps: deps})
+	return listing, nil
+}
+
+// object returns the contents of the object at path if they are cached.
+func (c *readCache) object(path string) (io.ReadCloser, bool) {
+	if !c.enabled() {
+		return nil, false
+	}
+	entry := c.get(objectCacheKey(path))
+	if entry == nil {
+		return nil, false
+	}
+	return io.NopCloser(bytes.NewReader(entry.data)), true
+}
+
+// fillObject caches the object at path as read from rc if it is small enough, and returns a reader of it
+// in place of rc. version is the version of the object from before it was opened.
+func (c *readCache) fillObject(path string, version fileVersion, rc io.ReadCloser) (io.ReadCloser, error) {
+	if !c.enabled() || !version.exists || version.size > maxCachedObjectSize {
+		return rc, nil
+	}
+
+	// Reading to the end verifies the object before it is cached
+	data, err := io.ReadAll(io.LimitReader(rc, maxCachedObjectSize+1))
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if len(data) > maxCachedObjectSize {
+		// The object is small on the volume but not once it is decoded
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), rc), rc}, nil
+	}
+	if err := rc.Close(); err != nil {
+		return nil, err
+	}
+
+	c.put(&cacheEntry{key: objectCacheKey(path), data: data, deps: fileVersions{path: version}})
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
@@ -0,0 +1,172 @@
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// enableCache turns on the shared cache for the test, and empties it once the test is done.
+func enableCache(t *testing.T, opts cacheOpts) {
+	sharedCache.configure(opts)
+	t.Cleanup(func() {
+		sharedCache.configure(cacheOpts{})
+	})
+}
+
+func readTestObject(t *testing.T, o *LocalVolumeObjectStore, bucket, key string) string {
+	rc, err := o.GetObject(bucket, key)
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	return string(data)
+}
+
+// touch moves the modification time of path forward, so that changes are noticed regardless of timestamp precision.
+func touch(t *testing.T, path string) {
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+}
+
+func Test_parseCacheOpts(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    cacheOpts
+		wantErr bool
+	}{
+		{name: "unset", data: map[string]string{}, want: cacheOpts{ttl: defaultCacheTTL}},
+		{
+			name: "all set",
+			data: map[string]string{"cacheSize": "64Mi", "cacheTTL": "1m"},
+			want: cacheOpts{size: 64 * 1024 * 1024, ttl: time.Minute},
+		},
+		{name: "invalid size", data: map[string]string{"cacheSize": "big"}, wantErr: true},
+		{name: "invalid ttl", data: map[string]string{"cacheTTL": "soon"}, wantErr: true},
+		{name: "negative ttl", data: map[string]string{"cacheTTL": "-1m"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseCacheOpts(test.data)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func Test_Cache_Objects(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	enableCache(t, cacheOpts{size: 1024 * 1024, ttl: time.Hour})
+	key := "backups/b1/velero-backup.json"
+	path := filepath.Join(root, "bucket", "backups", "b1", "velero-backup.json")
+
+	require.NoError(t, o.PutObject("bucket", key, strings.NewReader("v1")))
+	require.Equal(t, "v1", readTestObject(t, o, "bucket", key))
+	_, cached := sharedCache.object(path)
+	require.True(t, cached)
+
+	// Writes by the plugin are seen straight away
+	require.NoError(t, o.PutObject("bucket", key, strings.NewReader("v2")))
+	require.Equal(t, "v2", readTestObject(t, o, "bucket", key))
+
+	// So are changes made by other pods, here to an object without metadata
+	require.NoError(t, removeObjectMetadata(path))
+	require.Equal(t, "v2", readTestObject(t, o, "bucket", key))
+	require.NoError(t, os.WriteFile(path, []byte("v3"), 0644))
+	touch(t, path)
+	require.Equal(t, "v3", readTestObject(t, o, "bucket", key))
+
+	require.NoError(t, os.Remove(path))
+	_, err := o.GetObject("bucket", key)
+	require.Error(t, err, "a removed object is not served from the cache")
+}
+
+func Test_Cache_LargeObjects(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	enableCache(t, cacheOpts{size: 4 * maxCachedObjectSize, ttl: time.Hour})
+	key := "backups/b1/b1.tar.gz"
+	content := strings.Repeat("x", maxCachedObjectSize+1)
+
+	require.NoError(t, o.PutObject("bucket", key, strings.NewReader(content)))
+	require.Equal(t, content, readTestObject(t, o, "bucket", key))
+	_, cached := sharedCache.object(filepath.Join(root, "bucket", "backups", "b1", "b1.tar.gz"))
+	require.False(t, cached)
+}
+
+func Test_Cache_Listings(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	enableCache(t, cacheOpts{size: 1024 * 1024, ttl: time.Hour})
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("b1")))
+	keys, err := o.ListObjects("bucket", "backups/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/b1/velero-backup.json"}, keys)
+
+	// Writes by the plugin are seen straight away
+	require.NoError(t, o.PutObject("bucket", "backups/b2/velero-backup.json", strings.NewReader("b2")))
+	prefixes, err := o.ListCommonPrefixes("bucket", "backups/", "/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/b1/", "backups/b2/"}, prefixes)
+
+	// So are changes made by other pods, in any directory that was read
+	dir := filepath.Join(root, "bucket", "backups", "b1")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b1.tar.gz"), []byte("b1"), 0644))
+	touch(t, dir)
+	keys, err = o.ListObjects("bucket", "backups/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/b1/b1.tar.gz", "backups/b1/velero-backup.json", "backups/b2/velero-backup.json"}, keys)
+
+	require.NoError(t, o.DeleteObject("bucket", "backups/b2/velero-backup.json"))
+	prefixes, err = o.ListCommonPrefixes("bucket", "backups/", "/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/b1/"}, prefixes)
+}
+
+func Test_readCache(t *testing.T) {
+	dir := t.TempDir()
+	// Each listing takes 31 bytes, so two fit
+	cache := newReadCache()
+	cache.configure(cacheOpts{size: 70, ttl: time.Hour})
+	fills := 0
+	fill := func(deps fileVersions) ([]string, error) {
+		fills++
+		return []string{strings.Repeat("x", 30)}, deps.record(dir)
+	}
+
+	t.Run("entries are kept", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			_, err := cache.listing("a", fill)
+			require.NoError(t, err)
+		}
+		require.Equal(t, 1, fills)
+	})
+
+	t.Run("least recently used entries are evicted", func(t *testing.T) {
+		fills = 0
+		for _, key := range []string{"b", "a", "c"} {
+			_, err := cache.listing(key, fill)
+			require.NoError(t, err)
+		}
+		require.Equal(t, 2, fills)
+		require.Nil(t, cache.get("b"))
+		require.NotNil(t, cache.get("a"))
+	})
+
+	t.Run("entries expire", func(t *testing.T) {
+		cache.configure(cacheOpts{size: 70, ttl: time.Nanosecond})
+		fills = 0
+		_, err := cache.listing("a", fill)
+		require.NoError(t, err)
+		require.Equal(t, 1, fills)
+	})
+}
@@ -0,0 +1,284 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// partFilePrefix marks the part files of an object that is split into chunks. The parts of an object are
+// next to it, named after it and the ID of the write that created them, and the object's own file is
+// a manifest of its parts.
+const partFilePrefix = internalFilePrefix + "part."
+
+// chunkManifest is stored in place of an object that is split into part files.
+type chunkManifest struct {
+	ID string `json:"id"`
+	// Parts are the sizes of the part files, in order.
+	Parts []int64 `json:"parts"`
+}
+
+// partPath returns the path of part n of the object at path written by the write with the given ID.
+func partPath(path, id string, n int) string {
+	return filepath.Join(filepath.Dir(path), partFilePrefix+filepath.Base(path)+"."+id+"."+strconv.Itoa(n))
+}
+
+// stageChunkedFile is like stageFile, but if body is larger than chunkSize it is split into part files
+// of chunkSize and the staged file is a manifest of the parts. The parts are put in place when it is committed.
+func stageChunkedFile(path string, body io.Reader, chunkSize int64) (*stagedFile, error) {
+	if chunkSize == 0 {
+		return stageFile(path, body)
+	}
+
+	first, err := stageFile(path, io.LimitReader(body, chunkSize))
+	if err != nil {
+		return nil, err
+	}
+	var next [1]byte
+	n, err := io.ReadFull(body, next[:])
+	if err == io.EOF {
+		return first, nil
+	}
+	if err != nil {
+		first.Abort()
+		return nil, errors.Wrap(err, "failed to write temporary file")
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		first.Abort()
+		return nil, err
+	}
+	manifest := chunkManifest{ID: hex.EncodeToString(idBytes), Parts: []int64{first.size}}
+	first.path = partPath(path, manifest.ID, 0)
+	staged := &stagedFile{path: path, size: first.size, parts: []*stagedFile{first}}
+
+	rest := io.MultiReader(bytes.NewReader(next[:n]), body)
+	for {
+		// Parts already written are touched so that they aren't taken for an abandoned upload while the rest is written
+		now := time.Now()
+		for _, part := range staged.parts {
+			os.Chtimes(part.tempPath, now, now)
+		}
+
+		part, err := stageFile(partPath(path, manifest.ID, len(staged.parts)), io.LimitReader(rest, chunkSize))
+		if err != nil {
+			staged.Abort()
+			return nil, err
+		}
+		if part.size == 0 {
+			part.Abort()
+			break
+		}
+		staged.parts = append(staged.parts, part)
+		staged.size += part.size
+		manifest.Parts = append(manifest.Parts, part.size)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		staged.Abort()
+		return nil, err
+	}
+	file, err := stageFile(path, bytes.NewReader(data))
+	if err != nil {
+		staged.Abort()
+		return nil, err
+	}
+	staged.tempPath = file.tempPath
+	return staged, nil
+}
+
+// readChunkManifest reads the manifest of the chunked object at path.
+func readChunkManifest(r io.Reader, path string) (*chunkManifest, error) {
+	var manifest chunkManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, errors.Wrapf(err, "failed to read manifest of %s", path)
+	}
+	if manifest.ID == "" || len(manifest.Parts) == 0 {
+		return nil, errors.Errorf("invalid manifest of %s", path)
+	}
+	return &manifest, nil
+}
+
+// partsOf returns the paths of the part files of the object at path, or nothing if it isn't split into parts.
+func partsOf(path string) ([]string, error) {
+	md, err := readObjectMetadata(path)
+	if err != nil || md == nil || md.Parts == 0 {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	manifest, err := readChunkManifest(file, path)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]string, len(manifest.Parts))
+	for i := range manifest.Parts {
+		parts[i] = partPath(path, manifest.ID, i)
+	}
+	return parts, nil
+}
+
+// objectStoredSize returns the size of the object at path on the volume, including its part files.
+func objectStoredSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	parts, err := partsOf(path)
+	if err != nil || len(parts) == 0 {
+		return info.Size(), err
+	}
+	size := info.Size()
+	for _, part := range parts {
+		info, err := os.Stat(part)
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// removeParts removes part files that belonged to an object that was removed or replaced.
+func removeParts(parts []string) error {
+	for _, part := range parts {
+		if err := os.Remove(part); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove object part")
+		}
+	}
+	return nil
+}
+
+// removeObjectFile removes the object at path along with its part files, but not its metadata.
+func removeObjectFile(path string) error {
+	// The parts of an object with a damaged manifest are left to be removed as orphans on the next start
+	parts, _ := partsOf(path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return removeParts(parts)
+}
+
+// moveObject renames the object at path to newPath along with its metadata and part files.
+func moveObject(path, newPath string) error {
+	parts, err := partsOf(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(metadataPath(path), metadataPath(newPath)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to move object metadata")
+	}
+	for _, part := range parts {
+		newPart := filepath.Join(filepath.Dir(newPath), partFilePrefix+filepath.Base(newPath)+strings.TrimPrefix(filepath.Base(part), partFilePrefix+filepath.Base(path)))
+		if err := os.Rename(part, newPart); err != nil {
+			return errors.Wrap(err, "failed to move object part")
+		}
+	}
+	return os.Rename(path, newPath)
+}
+
+// openParts opens every part of the chunked object whose manifest is file, and returns them as one reader
+// along with their total size. They are all opened up front so that an overwrite can't remove them while they are read.
+func openParts(file *os.File) (io.ReadCloser, int64, error) {
+	manifest, err := readChunkManifest(file, file.Name())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	parts := &partsReadCloser{}
+	var size int64
+	for i := range manifest.Parts {
+		part, err := os.Open(partPath(file.Name(), manifest.ID, i))
+		if err != nil {
+			parts.Close()
+			return nil, 0, err
+		}
+		parts.files = append(parts.files, part)
+		info, err := part.Stat()
+		if err != nil {
+			parts.Close()
+			return nil, 0, errors.Wrap(err, "failed to stat object part")
+		}
+		size += info.Size()
+	}
+
+	readers := make([]io.Reader, len(parts.files))
+	for i, part := range parts.files {
+		readers[i] = part
+	}
+	parts.reader = io.MultiReader(readers...)
+	return parts, size, nil
+}
+
+// partsReadCloser reads the parts of a chunked object one after another.
+type partsReadCloser struct {
+	reader io.Reader
+	files  []*os.File
+}
+
+func (p *partsReadCloser) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (p *partsReadCloser) Close() error {
+	var err error
+	for _, file := range p.files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// removeOrphanedPart removes the part file at partPath if the object it belongs to no longer refers to it,
+// e.g. because the upload it was written by was interrupted before the manifest was put in place.
+func removeOrphanedPart(partPath string, info os.FileInfo, log *logrus.Entry) error {
+	// Parts are touched as they are committed, so a recent part may belong to a manifest about to be put in place
+	if time.Since(info.ModTime()) < staleTempFileAge {
+		return nil
+	}
+
+	// The part's name is the object's name followed by the ID of the write and the part number
+	name := strings.TrimPrefix(filepath.Base(partPath), partFilePrefix)
+	if i := strings.LastIndex(name, "."); i > 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, "."); i > 0 {
+		name = name[:i]
+	}
+	parts, err := partsOf(filepath.Join(filepath.Dir(partPath), name))
+	if err != nil {
+		// A damaged manifest is left for verification to report
+		return nil
+	}
+	for _, part := range parts {
+		if part == partPath {
+			return nil
+		}
+	}
+
+	log.Infof("Removing orphaned object part %s", partPath)
+	if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "could not remove %s", partPath)
+	}
+	return nil
+}
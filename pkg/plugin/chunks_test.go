@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func listParts(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	parts := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), partFilePrefix) {
+			parts = append(parts, entry.Name())
+		}
+	}
+	return parts
+}
+
+func Test_Chunks(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		encoding objectEncoding
+		parts    int
+	}{
+		{name: "smaller than a chunk", content: "0123456789", parts: 0},
+		{name: "exactly a chunk", content: strings.Repeat("0123456789", 10), parts: 0},
+		{name: "several chunks", content: strings.Repeat("0123456789", 25), parts: 3},
+		{name: "compressed", content: strings.Repeat("0123456789abcdef", 100) + "tail", encoding: objectEncoding{Compression: CompressionZstd}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o, root := newTestObjectStore(t, "bucket")
+			o.chunkSize = 100
+			o.encoding = test.encoding
+			key := "backups/b1/b1.tar.gz"
+			dir := filepath.Join(root, "bucket", "backups", "b1")
+
+			require.NoError(t, o.PutObject("bucket", key, strings.NewReader(test.content)))
+			if test.encoding.Compression == "" {
+				require.Len(t, listParts(t, dir), test.parts)
+			}
+
+			exists, err := o.ObjectExists("bucket", key)
+			require.NoError(t, err)
+			require.True(t, exists)
+			objects, err := o.ListObjects("bucket", "")
+			require.NoError(t, err)
+			require.Equal(t, []string{key}, objects, "parts are hidden")
+
+			rc, err := o.GetObject("bucket", key)
+			require.NoError(t, err)
+			got, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			require.Equal(t, test.content, string(got))
+
+			// Overwriting replaces the parts of the previous object
+			require.NoError(t, o.PutObject("bucket", key, strings.NewReader(test.content+test.content)))
+			rc, err = o.GetObject("bucket", key)
+			require.NoError(t, err)
+			got, err = io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			require.Equal(t, test.content+test.content, string(got))
+			parts, err := partsOf(filepath.Join(dir, "b1.tar.gz"))
+			require.NoError(t, err)
+			require.Len(t, listParts(t, dir), len(parts))
+
+			require.NoError(t, o.DeleteObject("bucket", key))
+			_, err = os.Stat(dir)
+			require.True(t, os.IsNotExist(err), "parts are removed with the object")
+		})
+	}
+}
+
+func Test_Chunks_SoftDeleteAndMirror(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	o.chunkSize = 10
+	o.softDelete = 24 * time.Hour
+	o.mirror = "mirror"
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "mirror"), 0755))
+	key := "backups/b1/b1.tar.gz"
+	content := strings.Repeat("abcdefghij", 5) + "tail"
+
+	require.NoError(t, o.PutObject("bucket", key, strings.NewReader(content)))
+	require.Len(t, listParts(t, filepath.Join(root, "mirror", "backups", "b1")), 6, "the mirror is chunked too")
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "mirror", "backups")))
+
+	require.NoError(t, o.DeleteObject("bucket", key))
+	restored, err := RestoreFromTrash("bucket", "backups/b1/")
+	require.NoError(t, err)
+	require.Equal(t, []string{key}, restored)
+
+	rc, err := o.GetObject("bucket", key)
+	require.NoError(t, err, "parts are restored with the object")
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, content, string(got))
+}
+
+func Test_removeOrphanedPart(t *testing.T) {
+	dir := t.TempDir()
+	log := logrus.NewEntry(logrus.New())
+	path := filepath.Join(dir, "b1.tar.gz")
+	staged, err := stageChunkedFile(path, strings.NewReader("0123456789"), 4)
+	require.NoError(t, err)
+	require.NoError(t, writeObjectMetadata(path, &objectMetadata{Size: 10, Parts: len(staged.parts)}))
+	require.NoError(t, staged.Commit())
+
+	orphan := partPath(path, "0000000000000000", 0)
+	require.NoError(t, os.WriteFile(orphan, []byte("orphan"), 0644))
+	old := time.Now().Add(-2 * staleTempFileAge)
+	for _, part := range listParts(t, dir) {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, part), old, old))
+	}
+
+	require.NoError(t, removeStaleFiles(dir, log))
+	require.NoFileExists(t, orphan)
+	require.Len(t, listParts(t, dir), 3, "parts of the object are kept")
+}
+
+func Test_Chunks_OverwriteWithSmallObject(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	o.chunkSize = 10
+	key := "backups/b1/b1.tar.gz"
+	path := filepath.Join(root, "bucket", "backups", "b1", "b1.tar.gz")
+	require.NoError(t, o.PutObject("bucket", key, strings.NewReader(strings.Repeat("abcdefghij", 3))))
+	manifest, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	require.NoError(t, o.PutObject("bucket", key, strings.NewReader("small")))
+	require.Empty(t, listParts(t, filepath.Dir(path)))
+	md, err := readObjectMetadata(path)
+	require.NoError(t, err)
+	require.NotNil(t, md)
+	require.Zero(t, md.Parts)
+
+	// The metadata of the new object goes in place before the object, so a reader in between, or a crash,
+	// finds the manifest of the previous object failing verification instead of returning it as the object
+	require.NoError(t, os.WriteFile(path, manifest, 0644))
+	rc, err := o.GetObject("bucket", key)
+	if err == nil {
+		_, err = io.ReadAll(rc)
+		rc.Close()
+	}
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Compression names an encoding applied to objects before they are written to the volume.
+// It is recorded in each object's metadata, so objects stay readable whatever the current setting is.
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionZstd Compression = "zstd"
+)
+
+// parseCompression validates the value of the "compression" BSL config key.
+func parseCompression(s string) (Compression, error) {
+	switch Compression(s) {
+	case CompressionNone, "none":
+		return CompressionNone, nil
+	case CompressionZstd:
+		return CompressionZstd, nil
+	}
+	return CompressionNone, errors.Errorf("unsupported compression %q, must be one of: none, zstd", s)
+}
+
+// compressReader returns a reader of everything read from src compressed with c.
+// Closing it also closes src.
+func compressReader(src io.ReadCloser, c Compression) (io.ReadCloser, error) {
+	if c != CompressionZstd {
+		return nil, errors.Errorf("unsupported compression %q", c)
+	}
+
+	return pipeThrough(src, func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	})
+}
+
+// decompressReadCloser returns the decompressed contents of an object stored with c.
+// Closing it also closes rc.
+func decompressReadCloser(rc io.ReadCloser, c Compression) (io.ReadCloser, error) {
+	if c != CompressionZstd {
+		return nil, errors.Errorf("object uses unsupported compression %q", c)
+	}
+
+	dec, err := zstd.NewReader(rc, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create decompressor")
+	}
+	return &decompressingReadCloser{Decoder: dec, closer: rc}, nil
+}
+
+type decompressingReadCloser struct {
+	*zstd.Decoder
+	closer io.Closer
+}
+
+func (r *decompressingReadCloser) Close() error {
+	r.Decoder.Close()
+	return r.closer.Close()
+}
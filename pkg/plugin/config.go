@@ -0,0 +1,386 @@
+package plugin
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// veleroConfigKeys are set in the config passed to the plugin by Velero itself, or read by Velero
+// from the BSL config, rather than configuring the plugin.
+var veleroConfigKeys = []string{"bucket", "prefix", "caCert", "credentialsFile", "resticRepoPrefix"}
+
+// storeConfigKeys configure how objects are stored, for every volume type.
+var storeConfigKeys = []string{
+	"compression",
+	"encryptionKeySecret",
+	"encryptionKeyId",
+	"retentionDays",
+	"softDeleteDays",
+	"maxVersions",
+	"deduplicate",
+	"chunkSize",
+	"freeSpaceReserve",
+	"quota",
+	"operationTimeout",
+}
+
+// volumeConfigKeys configure the volume of each volume type.
+var volumeConfigKeys = map[VolumeType][]string{
+	Hostpath: {"path"},
+	NFS:      {"path", "server", "readOnly", "persistentVolume", "mountOptions", "nfsVersion", "storageSize"},
+	PVC:      {"storageSize", "storageClassName", "existingClaim"},
+	CSI:      {"driver", "volumeHandle", "volumeAttributes", "nodePublishSecretRef", "fsType", "mountOptions", "storageSize"},
+}
+
+// nfsVersions are the values of the "nfsVersion" BSL config key, which sets the "nfsvers" mount option.
+var nfsVersions = []string{"3", "4", "4.0", "4.1", "4.2"}
+
+// defaultStaticVolumeSize is the capacity of the volumes the plugin provisions statically, unless "storageSize"
+// is set. Shared filesystems don't enforce it, but a persistent volume must have one.
+var defaultStaticVolumeSize = resource.MustParse("1Gi")
+
+// volumeConfig describes the volume of a bucket, from the BSL config.
+type volumeConfig struct {
+	volumeType VolumeType
+	bucket     string
+	// path is the directory on the host for hostpath volumes, and the exported directory for nfs volumes.
+	path   string
+	server string
+	// readOnly mounts the volume read-only, for locations that are only restored from.
+	readOnly bool
+	// persistentVolume mounts an nfs volume through a persistent volume provisioned statically rather than inline.
+	persistentVolume bool
+	// storageSize is the size of the claim created for pvc volumes, and of the persistent volume provisioned statically.
+	storageSize resource.Quantity
+	// storageClassName is nil to use the default storage class, and empty to use none.
+	storageClassName *string
+	// existingClaim is a claim provisioned outside of the plugin, mounted instead of creating one for pvc volumes.
+	existingClaim string
+	driver        string
+	// volumeHandle identifies the volume to the csi driver. Without one the volume is an inline ephemeral volume.
+	volumeHandle      string
+	volumeAttributes  map[string]string
+	nodePublishSecret string
+	fsType            string
+	// mountOptions are set on the persistent volume provisioned statically.
+	mountOptions []string
+}
+
+// bslConfig is the config of a BackupStorageLocation, parsed and validated once in Init.
+type bslConfig struct {
+	prefix string
+	volume volumeConfig
+	// mirror is the volume every write and delete is mirrored to, nil if there is none.
+	mirror              *volumeConfig
+	compression         Compression
+	encryptionKeySecret string
+	encryptionKeyID     string
+	retention           time.Duration
+	softDelete          time.Duration
+	maxVersions         int
+	deduplicate         bool
+	chunkSize           int64
+	reserve             spaceReserve
+	quota               int64
+	operationTimeout    time.Duration
+}
+
+// parseBSLConfig parses and validates the config of a BSL using the volume type vt. Every problem found is
+// reported in the one error, so that the status of the location shows all of them at once. Keys the plugin
+// doesn't know are returned as warnings rather than errors, since they may be meant for a newer version.
+func parseBSLConfig(vt VolumeType, config map[string]string) (*bslConfig, []string, error) {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	c := &bslConfig{prefix: config["prefix"]}
+	var err error
+	c.volume, err = parseVolumeConfig(vt, config, "")
+	check(err)
+
+	c.compression, err = parseCompression(config["compression"])
+	check(err)
+	c.encryptionKeySecret = config["encryptionKeySecret"]
+	c.encryptionKeyID = config["encryptionKeyId"]
+	c.retention, err = parseRetentionDays(config["retentionDays"])
+	check(err)
+	c.softDelete, err = parseSoftDeleteDays(config["softDeleteDays"])
+	check(err)
+	c.maxVersions, err = parseMaxVersions(config["maxVersions"])
+	check(err)
+	c.deduplicate, err = parseDeduplicate(config["deduplicate"])
+	check(err)
+	c.chunkSize, err = parseBytes("chunkSize", config["chunkSize"])
+	check(err)
+	if c.chunkSize > 0 && c.deduplicate {
+		check(errors.New("deduplicate can't be combined with chunkSize, deduplication needs hard links"))
+	}
+	c.reserve, err = parseSpaceReserve(config["freeSpaceReserve"])
+	check(err)
+	c.quota, err = parseBytes("quota", config["quota"])
+	check(err)
+	c.operationTimeout, err = parseOperationTimeout(config["operationTimeout"])
+	check(err)
+
+	mirrorType, mirrorConfig, err := getMirrorConfig(vt, config)
+	if err != nil {
+		check(errors.Wrap(err, "invalid mirror configuration"))
+	} else if mirrorConfig != nil {
+		mirror, err := parseVolumeConfig(mirrorType, mirrorConfig, mirrorConfigPrefix)
+		check(err)
+		c.mirror = &mirror
+		if c.volume.readOnly || mirror.readOnly {
+			check(errors.New("readOnly can't be combined with a mirror, every write is mirrored"))
+		}
+	}
+
+	if err := utilerrors.Flatten(utilerrors.NewAggregate(errs)); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid backup storage location config")
+	}
+	return c, unknownConfigKeys(vt, config), nil
+}
+
+// parseVolumeConfig validates the keys that configure a volume of type vt. The keys of a mirror volume
+// are named with keyPrefix in messages, e.g. "mirrorPath" for "path".
+func parseVolumeConfig(vt VolumeType, config map[string]string, keyPrefix string) (volumeConfig, error) {
+	name := func(key string) string {
+		if keyPrefix == "" {
+			return key
+		}
+		return keyPrefix + strings.ToUpper(key[:1]) + key[1:]
+	}
+	var errs []error
+
+	c := volumeConfig{volumeType: vt, bucket: config["bucket"]}
+	if c.bucket == "" {
+		errs = append(errs, errors.Errorf("%s is required", name("bucket")))
+	} else if _, err := resolveBucket(getRoot(), c.bucket); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch vt {
+	case Hostpath:
+		c.path = config["path"]
+		if err := validateVolumePath(name("path"), c.path); err != nil {
+			errs = append(errs, err)
+		}
+	case NFS:
+		c.path = config["path"]
+		if err := validateVolumePath(name("path"), c.path); err != nil {
+			errs = append(errs, err)
+		}
+		c.server = config["server"]
+		if err := validateServer(name("server"), c.server); err != nil {
+			errs = append(errs, err)
+		}
+		var err error
+		if c.readOnly, err = parseBool(name("readOnly"), config["readOnly"]); err != nil {
+			errs = append(errs, err)
+		}
+		if c.persistentVolume, err = parseBool(name("persistentVolume"), config["persistentVolume"]); err != nil {
+			errs = append(errs, err)
+		}
+		c.mountOptions = parseList(config["mountOptions"])
+		if version := config["nfsVersion"]; version != "" {
+			if !slices.Contains(nfsVersions, version) {
+				errs = append(errs, errors.Errorf("%s must be one of %s, got %q", name("nfsVersion"), strings.Join(nfsVersions, ", "), version))
+			}
+			for _, option := range c.mountOptions {
+				if strings.HasPrefix(option, "nfsvers=") || strings.HasPrefix(option, "vers=") {
+					errs = append(errs, errors.Errorf("%s can't be combined with the %s mount option", name("nfsVersion"), option))
+				}
+			}
+			c.mountOptions = append(c.mountOptions, "nfsvers="+version)
+		}
+		if len(c.mountOptions) > 0 && !c.persistentVolume {
+			errs = append(errs, errors.Errorf("%s and %s require %s, inline NFS volumes have no mount options", name("mountOptions"), name("nfsVersion"), name("persistentVolume")))
+		}
+		if c.persistentVolume {
+			c.storageSize = defaultStaticVolumeSize
+		}
+		if s := config["storageSize"]; s != "" {
+			if c.storageSize, err = parseQuantity(name("storageSize"), s); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	case PVC:
+		c.existingClaim = config["existingClaim"]
+		if c.existingClaim != "" {
+			if len(validation.IsDNS1123Subdomain(c.existingClaim)) > 0 {
+				errs = append(errs, errors.Errorf("%s must be the name of a persistent volume claim, got %q", name("existingClaim"), c.existingClaim))
+			}
+			for _, key := range []string{"storageSize", "storageClassName"} {
+				if _, ok := config[key]; ok {
+					errs = append(errs, errors.Errorf("%s can't be combined with %s, the claim is not created", name(key), name("existingClaim")))
+				}
+			}
+			break
+		}
+		if config["storageSize"] == "" {
+			errs = append(errs, errors.Errorf("%s is required for %s volumes", name("storageSize"), vt))
+		} else if size, err := parseQuantity(name("storageSize"), config["storageSize"]); err != nil {
+			errs = append(errs, err)
+		} else {
+			c.storageSize = size
+		}
+		if storageClassName, ok := config["storageClassName"]; ok {
+			if storageClassName != "" && len(validation.IsDNS1123Subdomain(storageClassName)) > 0 {
+				errs = append(errs, errors.Errorf("%s must be the name of a storage class, got %q", name("storageClassName"), storageClassName))
+			}
+			c.storageClassName = &storageClassName
+		}
+	case CSI:
+		c.driver = config["driver"]
+		if c.driver == "" {
+			errs = append(errs, errors.Errorf("%s is required for %s volumes", name("driver"), vt))
+		} else if len(validation.IsDNS1123Subdomain(c.driver)) > 0 {
+			errs = append(errs, errors.Errorf("%s must be the name of a CSI driver, got %q", name("driver"), c.driver))
+		}
+		c.volumeHandle = config["volumeHandle"]
+		attributes, err := parseKeyValues(name("volumeAttributes"), config["volumeAttributes"])
+		if err != nil {
+			errs = append(errs, err)
+		}
+		c.volumeAttributes = attributes
+		c.nodePublishSecret = config["nodePublishSecretRef"]
+		if c.nodePublishSecret != "" && len(validation.IsDNS1123Subdomain(c.nodePublishSecret)) > 0 {
+			errs = append(errs, errors.Errorf("%s must be the name of a secret, got %q", name("nodePublishSecretRef"), c.nodePublishSecret))
+		}
+		c.fsType = config["fsType"]
+		c.mountOptions = parseList(config["mountOptions"])
+		if len(c.mountOptions) > 0 && c.volumeHandle == "" {
+			errs = append(errs, errors.Errorf("%s requires %s, inline CSI volumes have no mount options", name("mountOptions"), name("volumeHandle")))
+		}
+		c.storageSize = defaultStaticVolumeSize
+		if s := config["storageSize"]; s != "" {
+			if c.storageSize, err = parseQuantity(name("storageSize"), s); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	default:
+		errs = append(errs, errors.Errorf("unsupported volume type %q", vt))
+	}
+
+	return c, utilerrors.NewAggregate(errs)
+}
+
+// parseQuantity parses a positive Kubernetes quantity, such as "10Gi".
+func parseQuantity(name, s string) (resource.Quantity, error) {
+	quantity, err := resource.ParseQuantity(s)
+	if err != nil || quantity.Sign() <= 0 {
+		return resource.Quantity{}, errors.Errorf("%s must be a quantity such as 10Gi, got %q", name, s)
+	}
+	return quantity, nil
+}
+
+// parseBool parses "true" or "false", which is false if s is empty.
+func parseBool(name, s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, errors.Errorf("%s must be true or false, got %q", name, s)
+	}
+	return b, nil
+}
+
+// parseList splits a comma separated list, such as "hard,nfsvers=4.1", dropping empty items.
+func parseList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseKeyValues parses a comma separated list of key=value pairs, such as "source=//server/share,subDir=velero".
+func parseKeyValues(name, s string) (map[string]string, error) {
+	items := parseList(s)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]string, len(items))
+	for _, item := range items {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, errors.Errorf("%s must be a list of key=value pairs such as a=1,b=2, got %q", name, s)
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return values, nil
+}
+
+// validateVolumePath checks that path is an absolute path without any "..".
+func validateVolumePath(name, path string) error {
+	if path == "" {
+		return errors.Errorf("%s is required", name)
+	}
+	if !filepath.IsAbs(path) {
+		return errors.Errorf("%s must be an absolute path, got %q", name, path)
+	}
+	for _, elem := range strings.Split(path, "/") {
+		if elem == ".." {
+			return errors.Errorf("%s must not contain \"..\", got %q", name, path)
+		}
+	}
+	return nil
+}
+
+// validateServer checks that server is an IP address or a host name.
+func validateServer(name, server string) error {
+	if server == "" {
+		return errors.Errorf("%s address is required", name)
+	}
+	if net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")) != nil {
+		return nil
+	}
+	if len(validation.IsDNS1123Subdomain(strings.ToLower(server))) > 0 {
+		return errors.Errorf("%s must be an IP address or a host name, got %q", name, server)
+	}
+	return nil
+}
+
+// unknownConfigKeys returns the keys of config that the plugin doesn't know for volume type vt, in sorted order.
+func unknownConfigKeys(vt VolumeType, config map[string]string) []string {
+	known := make(map[string]bool)
+	for _, keys := range [][]string{veleroConfigKeys, storeConfigKeys, volumeConfigKeys[vt]} {
+		for _, key := range keys {
+			known[key] = true
+		}
+	}
+
+	mirrorType := vt
+	if t, ok := config[mirrorConfigPrefix+"Type"]; ok {
+		mirrorType = VolumeType(t)
+	}
+	known[mirrorConfigPrefix+"Type"] = true
+	known[mirrorConfigPrefix+"Bucket"] = true
+	for _, key := range volumeConfigKeys[mirrorType] {
+		known[mirrorConfigPrefix+strings.ToUpper(key[:1])+key[1:]] = true
+	}
+
+	var unknown []string
+	for key := range config {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
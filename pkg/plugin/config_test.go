@@ -0,0 +1,210 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func Test_parseBSLConfig(t *testing.T) {
+	standard := "standard"
+	tests := []struct {
+		name         string
+		vt           VolumeType
+		config       map[string]string
+		want         *bslConfig
+		wantUnknown  []string
+		wantErrParts []string
+	}{
+		{
+			name:   "hostpath",
+			vt:     Hostpath,
+			config: map[string]string{"bucket": "snapshots", "prefix": "velero", "path": "/backups", "resticRepoPrefix": "/var/velero-local-volume-provider/snapshots/restic"},
+			want: &bslConfig{
+				prefix:           "velero",
+				volume:           volumeConfig{volumeType: Hostpath, bucket: "snapshots", path: "/backups"},
+				operationTimeout: defaultOperationTimeout,
+			},
+		},
+		{
+			name:   "nfs with a mirror",
+			vt:     NFS,
+			config: map[string]string{"bucket": "snapshots", "path": "/exports/backups", "server": "nfs.example.com", "mirrorServer": "10.0.0.2", "mirrorPath": "/exports/mirror"},
+			want: &bslConfig{
+				volume:           volumeConfig{volumeType: NFS, bucket: "snapshots", path: "/exports/backups", server: "nfs.example.com"},
+				mirror:           &volumeConfig{volumeType: NFS, bucket: "snapshots-mirror", path: "/exports/mirror", server: "10.0.0.2"},
+				operationTimeout: defaultOperationTimeout,
+			},
+		},
+		{
+			name: "nfs through a persistent volume",
+			vt:   NFS,
+			config: map[string]string{
+				"bucket":           "snapshots",
+				"path":             "/exports/backups",
+				"server":           "nfs.example.com",
+				"readOnly":         "true",
+				"persistentVolume": "true",
+				"mountOptions":     "hard,timeo=600",
+				"nfsVersion":       "4.1",
+			},
+			want: &bslConfig{
+				volume: volumeConfig{
+					volumeType:       NFS,
+					bucket:           "snapshots",
+					path:             "/exports/backups",
+					server:           "nfs.example.com",
+					storageSize:      defaultStaticVolumeSize,
+					readOnly:         true,
+					persistentVolume: true,
+					mountOptions:     []string{"hard", "timeo=600", "nfsvers=4.1"},
+				},
+				operationTimeout: defaultOperationTimeout,
+			},
+		},
+		{
+			name: "inline nfs volumes have no mount options",
+			vt:   NFS,
+			config: map[string]string{
+				"bucket":       "snapshots",
+				"path":         "/exports/backups",
+				"server":       "1.2.3.4",
+				"readOnly":     "true",
+				"mountOptions": "hard",
+				"nfsVersion":   "5",
+				"mirrorPath":   "/exports/mirror",
+				"mirrorServer": "1.2.3.4",
+			},
+			wantErrParts: []string{
+				"mountOptions and nfsVersion require persistentVolume",
+				`nfsVersion must be one of 3, 4, 4.0, 4.1, 4.2, got "5"`,
+				"readOnly can't be combined with a mirror",
+			},
+		},
+		{
+			name:   "pvc with store options",
+			vt:     PVC,
+			config: map[string]string{"bucket": "snapshots", "storageSize": "10Gi", "storageClassName": "standard", "compression": "zstd", "retentionDays": "30", "deduplicate": "true"},
+			want: &bslConfig{
+				volume:           volumeConfig{volumeType: PVC, bucket: "snapshots", storageSize: resource.MustParse("10Gi"), storageClassName: &standard},
+				compression:      CompressionZstd,
+				retention:        30 * 24 * time.Hour,
+				deduplicate:      true,
+				operationTimeout: defaultOperationTimeout,
+			},
+		},
+		{
+			name: "csi with a static volume",
+			vt:   CSI,
+			config: map[string]string{
+				"bucket":               "snapshots",
+				"driver":               "smb.csi.k8s.io",
+				"volumeHandle":         "fileserver/backups",
+				"volumeAttributes":     "source=//fileserver/backups, subDir=velero",
+				"nodePublishSecretRef": "smb-credentials",
+				"mountOptions":         "dir_mode=0770,vers=3.0",
+			},
+			want: &bslConfig{
+				volume: volumeConfig{
+					volumeType:        CSI,
+					bucket:            "snapshots",
+					storageSize:       defaultStaticVolumeSize,
+					driver:            "smb.csi.k8s.io",
+					volumeHandle:      "fileserver/backups",
+					volumeAttributes:  map[string]string{"source": "//fileserver/backups", "subDir": "velero"},
+					nodePublishSecret: "smb-credentials",
+					mountOptions:      []string{"dir_mode=0770", "vers=3.0"},
+				},
+				operationTimeout: defaultOperationTimeout,
+			},
+		},
+		{
+			name:   "inline csi volumes have no mount options",
+			vt:     CSI,
+			config: map[string]string{"bucket": "snapshots", "volumeAttributes": "source", "mountOptions": "hard"},
+			wantErrParts: []string{
+				"driver is required for csi volumes",
+				`volumeAttributes must be a list of key=value pairs such as a=1,b=2, got "source"`,
+				"mountOptions requires volumeHandle",
+			},
+		},
+		{
+			name:   "pvc with an existing claim",
+			vt:     PVC,
+			config: map[string]string{"bucket": "snapshots", "existingClaim": "backups"},
+			want: &bslConfig{
+				volume:           volumeConfig{volumeType: PVC, bucket: "snapshots", existingClaim: "backups"},
+				operationTimeout: defaultOperationTimeout,
+			},
+		},
+		{
+			name:   "existing claims are not created",
+			vt:     PVC,
+			config: map[string]string{"bucket": "snapshots", "existingClaim": "Backups", "storageSize": "10Gi"},
+			wantErrParts: []string{
+				`existingClaim must be the name of a persistent volume claim, got "Backups"`,
+				"storageSize can't be combined with existingClaim",
+			},
+		},
+		{
+			name:         "pvc without a storage size",
+			vt:           PVC,
+			config:       map[string]string{"bucket": "snapshots"},
+			wantErrParts: []string{"storageSize is required for pvc volumes"},
+		},
+		{
+			name:   "unknown keys are only warned about",
+			vt:     Hostpath,
+			config: map[string]string{"bucket": "snapshots", "path": "/backups", "server": "1.2.3.4", "retentiondays": "30"},
+			want: &bslConfig{
+				volume:           volumeConfig{volumeType: Hostpath, bucket: "snapshots", path: "/backups"},
+				operationTimeout: defaultOperationTimeout,
+			},
+			wantUnknown: []string{"retentiondays", "server"},
+		},
+		{
+			name: "every problem is reported",
+			vt:   NFS,
+			config: map[string]string{
+				"bucket":        "snapshots",
+				"path":          "exports/backups",
+				"server":        "nfs server",
+				"deduplicate":   "yes",
+				"quota":         "lots",
+				"mirrorType":    "pvc",
+				"mirrorBucket":  "mirror",
+				"mirrorStorage": "10Gi",
+			},
+			wantErrParts: []string{
+				`path must be an absolute path, got "exports/backups"`,
+				`server must be an IP address or a host name, got "nfs server"`,
+				`deduplicate must be true or false, got "yes"`,
+				`quota must be a quantity such as 10Gi, got "lots"`,
+				"mirrorStorageSize is required for pvc volumes",
+			},
+		},
+		{
+			name:         "paths must stay inside the export",
+			vt:           NFS,
+			config:       map[string]string{"bucket": "snapshots", "path": "/exports/../etc", "server": "1.2.3.4"},
+			wantErrParts: []string{`path must not contain ".."`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, unknown, err := parseBSLConfig(tt.vt, tt.config)
+			if len(tt.wantErrParts) > 0 {
+				require.Error(t, err)
+				for _, part := range tt.wantErrParts {
+					require.Contains(t, err.Error(), part)
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.wantUnknown, unknown)
+		})
+	}
+}
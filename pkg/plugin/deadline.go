@@ -0,0 +1,343 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultOperationTimeout is how long a filesystem operation can be blocked on the volume before it is
+// considered hung, unless the "operationTimeout" BSL config key is set.
+const defaultOperationTimeout = 2 * time.Minute
+
+// retryBackoff is the wait before each retry of an operation that failed with a transient error.
+var retryBackoff = []time.Duration{200 * time.Millisecond, time.Second, 5 * time.Second}
+
+// TimeoutError is returned when a filesystem operation doesn't finish within the operation timeout,
+// e.g. because the NFS server is unreachable. Calls into the kernel can't be interrupted, so the
+// operation is left running and the bucket stays unavailable until it returns.
+type TimeoutError struct {
+	Bucket  string
+	Op      string
+	Timeout time.Duration
+	// Blocked is set if the operation was refused because an earlier operation is still blocked.
+	Blocked bool
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Blocked {
+		return fmt.Sprintf("bucket %q is unavailable: an earlier %s is still blocked on the volume", e.Bucket, e.Op)
+	}
+	return fmt.Sprintf("%s on bucket %q did not finish within %s, the volume may be unreachable", e.Op, e.Bucket, e.Timeout)
+}
+
+// parseOperationTimeout validates the value of the "operationTimeout" BSL config key. "0" disables the timeout.
+func parseOperationTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultOperationTimeout, nil
+	}
+	timeout, err := time.ParseDuration(s)
+	if err != nil || timeout < 0 {
+		return 0, errors.Errorf("operationTimeout must be a duration such as 2m, got %q", s)
+	}
+	return timeout, nil
+}
+
+// blockedOps holds the operation still blocked on each bucket after timing out. Object stores are created
+// for each request, so state that has to outlive a request, like this and the per-bucket throttles and
+// read cache, is kept in package variables shared by all of them.
+var blockedOps = struct {
+	mu  sync.Mutex
+	ops map[string]string
+}{ops: make(map[string]string)}
+
+// isTransient returns truthy for errors from a network filesystem that may succeed if the operation is retried.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.EIO)
+}
+
+// operationTimeout runs filesystem operations with a deadline.
+type operationTimeout struct {
+	timeout time.Duration
+}
+
+// run calls fn and waits for it to be blocked for up to the timeout. Readers paused by the watchdog fn is
+// passed stop the clock, and progress readers restart it. If retry is set, fn is called again after
+// transient errors, so it must be safe to repeat.
+func (t operationTimeout) run(bucket, op string, retry bool, fn func(w *watchdog) error) error {
+	if t.timeout == 0 {
+		return fn(&watchdog{})
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := t.runOnce(bucket, op, fn)
+		if !retry || !isTransient(err) || attempt == len(retryBackoff) {
+			return err
+		}
+		time.Sleep(retryBackoff[attempt])
+	}
+}
+
+// blocked returns a *TimeoutError if an earlier operation on bucket is still blocked.
+func (t operationTimeout) blocked(bucket string) error {
+	blockedOps.mu.Lock()
+	defer blockedOps.mu.Unlock()
+	if blockedOp, ok := blockedOps.ops[bucket]; ok {
+		return &TimeoutError{Bucket: bucket, Op: blockedOp, Timeout: t.timeout, Blocked: true}
+	}
+	return nil
+}
+
+func (t operationTimeout) runOnce(bucket, op string, fn func(w *watchdog) error) error {
+	if err := t.blocked(bucket); err != nil {
+		return err
+	}
+
+	w := &watchdog{busySince: time.Now()}
+	done := make(chan error, 1)
+	go func() {
+		err := fn(w)
+
+		blockedOps.mu.Lock()
+		if blockedOps.ops[bucket] == op && w.timedOut() {
+			delete(blockedOps.ops, bucket)
+		}
+		blockedOps.mu.Unlock()
+		done <- err
+	}()
+
+	interval := t.timeout / 10
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			if w.idleFor() < t.timeout {
+				continue
+			}
+			blockedOps.mu.Lock()
+			w.timeOut()
+			blockedOps.ops[bucket] = op
+			blockedOps.mu.Unlock()
+			return &TimeoutError{Bucket: bucket, Op: op, Timeout: t.timeout}
+		}
+	}
+}
+
+// reader returns a reader that reads from rc with a deadline on each read.
+func (t operationTimeout) reader(bucket, op string, rc io.ReadCloser) io.ReadCloser {
+	if t.timeout == 0 {
+		return rc
+	}
+	return &deadlineReadCloser{rc: rc, timeout: t, bucket: bucket, op: op}
+}
+
+// deadlineReadCloser reads from rc with a deadline on each read. The reads are made by a single goroutine
+// for the whole stream, so that a read that times out can be left running. Once a read has timed out the
+// stream is broken, and every later read fails with the same error rather than skipping what it returns.
+type deadlineReadCloser struct {
+	rc      io.ReadCloser
+	timeout operationTimeout
+	bucket  string
+	op      string
+
+	requests chan []byte
+	results  chan deadlineReadResult
+	timer    *time.Timer
+	// buf is what the goroutine reads into, since p can't be written to once a read that timed out returns
+	buf []byte
+	err error
+
+	// pending and expired are guarded by blockedOps.mu, as they decide whether the bucket is blocked
+	pending bool
+	expired bool
+}
+
+type deadlineReadResult struct {
+	n   int
+	err error
+}
+
+func (d *deadlineReadCloser) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if err := d.timeout.blocked(d.bucket); err != nil {
+		return 0, err
+	}
+	if d.requests == nil {
+		d.requests = make(chan []byte)
+		d.results = make(chan deadlineReadResult, 1)
+		d.timer = time.NewTimer(d.timeout.timeout)
+		go d.readLoop()
+	} else {
+		d.timer.Reset(d.timeout.timeout)
+	}
+	if cap(d.buf) < len(p) {
+		d.buf = make([]byte, len(p))
+	}
+
+	blockedOps.mu.Lock()
+	d.pending = true
+	blockedOps.mu.Unlock()
+	d.requests <- d.buf[:len(p)]
+
+	select {
+	case result := <-d.results:
+		d.timer.Stop()
+		return copy(p, d.buf[:result.n]), result.err
+	case <-d.timer.C:
+		blockedOps.mu.Lock()
+		if !d.pending {
+			// The read returned just in time
+			blockedOps.mu.Unlock()
+			result := <-d.results
+			return copy(p, d.buf[:result.n]), result.err
+		}
+		d.expired = true
+		blockedOps.ops[d.bucket] = d.op
+		blockedOps.mu.Unlock()
+		d.err = &TimeoutError{Bucket: d.bucket, Op: d.op, Timeout: d.timeout.timeout}
+		return 0, d.err
+	}
+}
+
+// readLoop makes the reads requested by Read until the stream is closed or a read times out.
+func (d *deadlineReadCloser) readLoop() {
+	for buf := range d.requests {
+		n, err := d.rc.Read(buf)
+
+		blockedOps.mu.Lock()
+		d.pending = false
+		expired := d.expired
+		if expired && blockedOps.ops[d.bucket] == d.op {
+			delete(blockedOps.ops, d.bucket)
+		}
+		blockedOps.mu.Unlock()
+		if expired {
+			return
+		}
+		d.results <- deadlineReadResult{n: n, err: err}
+	}
+}
+
+func (d *deadlineReadCloser) Close() error {
+	if d.requests != nil && d.err == nil {
+		close(d.requests)
+	}
+	if d.err == nil {
+		d.err = os.ErrClosed
+	}
+	return d.timeout.run(d.bucket, d.op, false, func(w *watchdog) error {
+		return d.rc.Close()
+	})
+}
+
+// watchdog tracks how long an operation has been blocked on the filesystem. Readers paused by it,
+// e.g. of an upload from Velero, don't count towards the time.
+type watchdog struct {
+	mu        sync.Mutex
+	busySince time.Time
+	paused    int
+	expired   bool
+}
+
+// idleFor returns how long the operation has been busy without being paused.
+func (w *watchdog) idleFor() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.paused > 0 {
+		return 0
+	}
+	return time.Since(w.busySince)
+}
+
+func (w *watchdog) timeOut() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.expired = true
+}
+
+func (w *watchdog) timedOut() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.expired
+}
+
+// pause returns a reader of r that stops the clock while it is being read from.
+func (w *watchdog) pause(r io.Reader) io.Reader {
+	return &pausedReader{r: r, w: w}
+}
+
+// progress returns a reader of r that restarts the clock after each read, for operations that read
+// from the filesystem for longer than the timeout.
+func (w *watchdog) progress(r io.Reader) io.Reader {
+	return &progressReader{r: r, w: w}
+}
+
+type progressReader struct {
+	r io.Reader
+	w *watchdog
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.w.mu.Lock()
+	p.w.busySince = time.Now()
+	p.w.mu.Unlock()
+	return n, err
+}
+
+// sleep waits for d without it counting towards the timeout of the operation.
+func (w *watchdog) sleep(d time.Duration) {
+	w.whilePaused(func() {
+		time.Sleep(d)
+	})
+}
+
+// whilePaused calls fn, which waits for something other than the filesystem, with the clock stopped.
+func (w *watchdog) whilePaused(fn func()) {
+	if w == nil {
+		fn()
+		return
+	}
+	w.mu.Lock()
+	w.paused++
+	w.mu.Unlock()
+
+	fn()
+
+	w.mu.Lock()
+	w.paused--
+	w.busySince = time.Now()
+	w.mu.Unlock()
+}
+
+type pausedReader struct {
+	r io.Reader
+	w *watchdog
+}
+
+func (p *pausedReader) Read(b []byte) (int, error) {
+	p.w.mu.Lock()
+	p.w.paused++
+	p.w.mu.Unlock()
+
+	n, err := p.r.Read(b)
+
+	p.w.mu.Lock()
+	p.w.paused--
+	p.w.busySince = time.Now()
+	p.w.mu.Unlock()
+	return n, err
+}
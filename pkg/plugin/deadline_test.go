@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseOperationTimeout(t *testing.T) {
+	timeout, err := parseOperationTimeout("")
+	require.NoError(t, err)
+	require.Equal(t, defaultOperationTimeout, timeout)
+
+	timeout, err = parseOperationTimeout("30s")
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, timeout)
+
+	timeout, err = parseOperationTimeout("0")
+	require.NoError(t, err)
+	require.Zero(t, timeout)
+
+	_, err = parseOperationTimeout("-1m")
+	require.Error(t, err)
+	_, err = parseOperationTimeout("soon")
+	require.Error(t, err)
+}
+
+func Test_operationTimeout_run(t *testing.T) {
+	timeout := operationTimeout{timeout: 50 * time.Millisecond}
+	unblock := make(chan struct{})
+	returned := make(chan struct{})
+
+	var timeoutErr *TimeoutError
+	err := timeout.run("hung-bucket", "ListObjects", true, func(w *watchdog) error {
+		defer close(returned)
+		<-unblock
+		return nil
+	})
+	require.ErrorAs(t, err, &timeoutErr)
+	require.False(t, timeoutErr.Blocked)
+
+	// Nothing else runs against the bucket while the operation is still blocked
+	err = timeout.run("hung-bucket", "ObjectExists", true, func(w *watchdog) error {
+		t.Fatal("operation ran on a blocked bucket")
+		return nil
+	})
+	require.ErrorAs(t, err, &timeoutErr)
+	require.True(t, timeoutErr.Blocked)
+	require.Equal(t, "ListObjects", timeoutErr.Op)
+
+	close(unblock)
+	<-returned
+	require.Eventually(t, func() bool {
+		return timeout.run("hung-bucket", "ObjectExists", true, func(w *watchdog) error { return nil }) == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_operationTimeout_retry(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = []time.Duration{time.Millisecond, time.Millisecond}
+	t.Cleanup(func() { retryBackoff = backoff })
+
+	timeout := operationTimeout{timeout: time.Second}
+	attempts := 0
+	err := timeout.run("bucket", "ListObjects", true, func(w *watchdog) error {
+		attempts++
+		if attempts < 3 {
+			return &os.PathError{Op: "readdirent", Path: "backups", Err: syscall.ESTALE}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = timeout.run("bucket", "PutObject", false, func(w *watchdog) error {
+		attempts++
+		return &os.PathError{Op: "write", Path: "backups", Err: syscall.EIO}
+	})
+	require.ErrorIs(t, err, syscall.EIO)
+	require.Equal(t, 1, attempts, "operations that aren't safe to repeat are not retried")
+}
+
+func Test_operationTimeout_pause(t *testing.T) {
+	timeout := operationTimeout{timeout: 50 * time.Millisecond}
+
+	// A slow upload from Velero is not a hung volume
+	err := timeout.run("bucket", "PutObject", false, func(w *watchdog) error {
+		_, err := io.Copy(io.Discard, w.pause(&slowReader{r: strings.NewReader("abc"), delay: 40 * time.Millisecond}))
+		return err
+	})
+	require.NoError(t, err)
+
+	// Neither is a long read that keeps making progress
+	err = timeout.run("bucket", "GetObject", false, func(w *watchdog) error {
+		_, err := io.Copy(io.Discard, w.progress(&slowReader{r: strings.NewReader("abc"), delay: 40 * time.Millisecond}))
+		return err
+	})
+	require.NoError(t, err)
+}
+
+// slowReader reads a byte at a time from r, waiting delay before each read.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p[:1])
+}
+
+func Test_BlockedBucket(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	o.timeout.timeout = time.Minute
+	// Resolving keys follows symlinks, which would hang on an unreachable volume, so it must not happen
+	// before the bucket is found to be blocked
+	require.NoError(t, os.Symlink(t.TempDir(), filepath.Join(root, "bucket", "backups")))
+	blockedOps.mu.Lock()
+	blockedOps.ops["bucket"] = "ListObjects"
+	blockedOps.mu.Unlock()
+	t.Cleanup(func() {
+		blockedOps.mu.Lock()
+		delete(blockedOps.ops, "bucket")
+		blockedOps.mu.Unlock()
+	})
+
+	key := "backups/b1/velero-backup.json"
+	_, existsErr := o.ObjectExists("bucket", key)
+	_, getErr := o.GetObject("bucket", key)
+	_, prefixesErr := o.ListCommonPrefixes("bucket", "backups/", "/")
+	_, objectsErr := o.ListObjects("bucket", "backups/")
+	for _, err := range []error{
+		o.PutObject("bucket", key, strings.NewReader("{}")),
+		existsErr,
+		getErr,
+		prefixesErr,
+		objectsErr,
+		o.DeleteObject("bucket", key),
+	} {
+		var timeoutErr *TimeoutError
+		require.ErrorAs(t, err, &timeoutErr)
+		require.True(t, timeoutErr.Blocked)
+	}
+}
+
+func Test_deadlineReadCloser(t *testing.T) {
+	timeout := operationTimeout{timeout: 50 * time.Millisecond}
+
+	rc := timeout.reader("bucket", "GetObject", io.NopCloser(iotest.OneByteReader(strings.NewReader("abcdef"))))
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, "abcdef", string(got))
+	require.NoError(t, rc.Close())
+	_, err = rc.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrClosed)
+
+	// A read that times out breaks the stream, even once it returns
+	pr, pw := io.Pipe()
+	rc = timeout.reader("hung-stream", "GetObject", pr)
+	var timeoutErr *TimeoutError
+	_, err = rc.Read(make([]byte, 4))
+	require.ErrorAs(t, err, &timeoutErr)
+	require.False(t, timeoutErr.Blocked)
+	go pw.Write([]byte("late"))
+	require.Eventually(t, func() bool {
+		return timeout.blocked("hung-stream") == nil
+	}, time.Second, 10*time.Millisecond, "the bucket is available once the read returns")
+	n, err := rc.Read(make([]byte, 4))
+	require.Zero(t, n)
+	require.ErrorAs(t, err, &timeoutErr)
+	require.False(t, timeoutErr.Blocked)
+	require.NoError(t, rc.Close())
+}
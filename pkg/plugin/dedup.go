@@ -0,0 +1,129 @@
+package plugin
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// blobDirName is the directory at the root of a bucket that holds the content of deduplicated objects,
+// named by the sha256 of the content as stored. Each deduplicated object is a hard link to its blob,
+// so a blob is no longer used once it is the only link left.
+const blobDirName = internalFilePrefix + "objects"
+
+// parseDeduplicate validates the value of the "deduplicate" BSL config key.
+func parseDeduplicate(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	deduplicate, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, errors.Errorf("deduplicate must be true or false, got %q", s)
+	}
+	return deduplicate, nil
+}
+
+// blobPath returns the path of the blob with the sha256 sum in the bucket at bucketPath.
+// Blobs are spread over directories by the first byte of the sum to keep the directories small.
+func blobPath(bucketPath, sum string) string {
+	return filepath.Join(bucketPath, blobDirName, sum[:2], sum)
+}
+
+// linkBlob makes the staged file a link to the blob with the sha256 sum of its content, storing it as the blob
+// if there isn't one yet. Committing the staged file then puts the link in place.
+func linkBlob(bucketPath, sum string, staged *stagedFile) error {
+	blob := blobPath(bucketPath, sum)
+	if err := createDirs(filepath.Dir(blob)); err != nil {
+		return err
+	}
+
+	// A blob can be removed as unused between finding it and linking to it, so it is tried again
+	for attempt := 0; attempt < 3; attempt++ {
+		err := os.Link(staged.tempPath, blob)
+		if err == nil {
+			return syncDir(filepath.Dir(blob))
+		}
+		if !os.IsExist(err) {
+			return errors.Wrap(err, "failed to store blob")
+		}
+
+		// The content is already stored, so the staged copy is replaced with a link to it
+		linkPath := staged.tempPath + ".link"
+		if err := os.Link(blob, linkPath); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.Wrap(err, "failed to link blob")
+		}
+		if err := os.Rename(linkPath, staged.tempPath); err != nil {
+			os.Remove(linkPath)
+			return errors.Wrap(err, "failed to link blob")
+		}
+		// Objects written without a retention period are retained since they were last modified,
+		// which is now for every object sharing the blob
+		now := time.Now()
+		if err := os.Chtimes(blob, now, now); err != nil {
+			return err
+		}
+		return nil
+	}
+	return errors.Errorf("failed to link blob %s", sum)
+}
+
+// removeUnusedBlob removes the blob with the sha256 sum from the bucket at bucketPath if no object links to it.
+func removeUnusedBlob(bucketPath, sum string, log *logrus.Entry) error {
+	if len(sum) < 2 {
+		return nil
+	}
+	blob := blobPath(bucketPath, sum)
+	info, err := os.Stat(blob)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if linkCount(info) > 1 {
+		return nil
+	}
+	log.WithField("blob", sum).Debug("Removing unused blob")
+	if err := os.Remove(blob); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeUnusedBlobs removes every blob in the bucket at bucketPath that no object links to, including blobs of
+// objects that were only removed from the trash or the previous versions.
+func removeUnusedBlobs(bucketPath string, log *logrus.Entry) error {
+	err := filepath.WalkDir(filepath.Join(bucketPath, blobDirName), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return removeUnusedBlob(bucketPath, d.Name(), log)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to remove unused blobs")
+	}
+	return nil
+}
+
+// linkCount returns the number of hard links to a file.
+func linkCount(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func countBlobs(t *testing.T, bucketPath string) int {
+	count := 0
+	err := filepath.Walk(filepath.Join(bucketPath, blobDirName), func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		require.NoError(t, err)
+		if info.Mode().IsRegular() {
+			count++
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return count
+}
+
+func Test_Deduplicate(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	o.deduplicate = true
+	bucketPath := filepath.Join(root, "bucket")
+	content := strings.Repeat("resource list", 100)
+
+	keys := []string{"backups/b1/b1-resource-list.json.gz", "backups/b2/b2-resource-list.json.gz"}
+	for _, key := range keys {
+		require.NoError(t, o.PutObject("bucket", key, strings.NewReader(content)))
+	}
+	require.NoError(t, o.PutObject("bucket", "backups/b2/b2.tar.gz", strings.NewReader("different")))
+	require.Equal(t, 2, countBlobs(t, bucketPath))
+
+	for _, key := range keys {
+		rc, err := o.GetObject("bucket", key)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, content, string(got))
+	}
+
+	objects, err := o.ListObjects("bucket", "")
+	require.NoError(t, err)
+	require.Len(t, objects, 3, "blobs are hidden")
+
+	usage, err := BucketUsage("bucket")
+	require.NoError(t, err)
+	require.Equal(t, 3, usage.Objects)
+	require.Equal(t, int64(2*len(content)+len("different")), usage.LogicalBytes)
+	require.Less(t, usage.PhysicalBytes, usage.LogicalBytes)
+
+	require.NoError(t, o.DeleteObject("bucket", keys[0]))
+	require.Equal(t, 2, countBlobs(t, bucketPath), "blobs still linked to are kept")
+	rc, err := o.GetObject("bucket", keys[1])
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	require.NoError(t, o.DeleteObject("bucket", keys[1]))
+	require.Equal(t, 1, countBlobs(t, bucketPath), "unused blobs are removed")
+
+	require.NoError(t, o.PutObject("bucket", "backups/b2/b2.tar.gz", strings.NewReader("overwritten")))
+	require.Equal(t, 1, countBlobs(t, bucketPath), "the blob of an overwritten object is removed")
+}
+
+func Test_removeUnusedBlobs(t *testing.T) {
+	bucketPath := t.TempDir()
+	sum := strings.Repeat("ab", 32)
+	blob := blobPath(bucketPath, sum)
+	require.NoError(t, os.MkdirAll(filepath.Dir(blob), 0755))
+	require.NoError(t, os.WriteFile(blob, []byte("data"), 0644))
+
+	used := strings.Repeat("cd", 32)
+	require.NoError(t, os.MkdirAll(filepath.Dir(blobPath(bucketPath, used)), 0755))
+	require.NoError(t, os.WriteFile(blobPath(bucketPath, used), []byte("data"), 0644))
+	require.NoError(t, os.Link(blobPath(bucketPath, used), filepath.Join(bucketPath, "object")))
+
+	require.NoError(t, removeUnusedBlobs(bucketPath, logrus.NewEntry(logrus.New())))
+	require.NoFileExists(t, blob)
+	require.FileExists(t, blobPath(bucketPath, used))
+}
+
+func Test_Deduplicate_Quota(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	o.deduplicate = true
+	o.space = &spaceGuard{quota: 1024 * 1024}
+
+	require.NoError(t, o.PutObject("bucket", "a", strings.NewReader("first")))
+	require.NoError(t, o.PutObject("bucket", "b", strings.NewReader("second")))
+	require.Equal(t, 2, countBlobs(t, filepath.Join(root, "bucket")), "different objects don't share a blob")
+
+	for key, want := range map[string]string{"a": "first", "b": "second"} {
+		rc, err := o.GetObject("bucket", key)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, want, string(got))
+	}
+}
@@ -0,0 +1,117 @@
+package plugin
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// objectEncoding describes how an object is transformed before it is written to the volume.
+// It is recorded in the object's metadata, so an object can always be read back the way it was written
+// whatever the current settings of the BackupStorageLocation are.
+type objectEncoding struct {
+	Compression         Compression `json:"compression,omitempty"`
+	EncryptionKeySecret string      `json:"encryptionKeySecret,omitempty"`
+	EncryptionKeyID     string      `json:"encryptionKeyId,omitempty"`
+}
+
+// encoded returns truthy if objects are not stored as is.
+func (e objectEncoding) encoded() bool {
+	return e.Compression != CompressionNone || e.encrypted()
+}
+
+// encrypted returns truthy if objects are encrypted.
+func (e objectEncoding) encrypted() bool {
+	return e.EncryptionKeyID != ""
+}
+
+// encodeReader returns the contents of body as they are to be stored with encoding e.
+// Objects are compressed before they are encrypted, since encrypted data doesn't compress.
+// The returned reader must be closed to stop the encoding if it isn't read to the end.
+func encodeReader(body io.Reader, e objectEncoding, keys *Keyring) (io.ReadCloser, error) {
+	rc := io.NopCloser(body)
+
+	if e.Compression != CompressionNone {
+		compressed, err := compressReader(rc, e.Compression)
+		if err != nil {
+			return nil, err
+		}
+		rc = compressed
+	}
+
+	if e.encrypted() {
+		key, err := keys.key(e.EncryptionKeySecret, e.EncryptionKeyID)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		encrypted, err := encryptReader(rc, key)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		rc = encrypted
+	}
+
+	return rc, nil
+}
+
+// decodeReadCloser returns the original contents of an object stored with encoding e.
+// Closing it also closes rc.
+func decodeReadCloser(rc io.ReadCloser, e objectEncoding, keys *Keyring) (io.ReadCloser, error) {
+	if e.encrypted() {
+		if keys == nil {
+			return nil, errors.New("object is encrypted but no encryption keys are available")
+		}
+		key, err := keys.key(e.EncryptionKeySecret, e.EncryptionKeyID)
+		if err != nil {
+			return nil, err
+		}
+		decrypted, err := decryptReadCloser(rc, key)
+		if err != nil {
+			return nil, err
+		}
+		rc = decrypted
+	}
+
+	if e.Compression != CompressionNone {
+		decompressed, err := decompressReadCloser(rc, e.Compression)
+		if err != nil {
+			return nil, err
+		}
+		rc = decompressed
+	}
+
+	return rc, nil
+}
+
+// pipeThrough returns a reader of everything read from src and written through the writer returned by newWriter.
+// Closing the returned reader also closes src.
+func pipeThrough(src io.ReadCloser, newWriter func(io.Writer) (io.WriteCloser, error)) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	w, err := newWriter(pw)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if _, err := io.Copy(w, src); err != nil {
+			w.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+
+	return &pipeReader{PipeReader: pr, src: src}, nil
+}
+
+type pipeReader struct {
+	*io.PipeReader
+	src io.Closer
+}
+
+func (r *pipeReader) Close() error {
+	r.PipeReader.Close()
+	return r.src.Close()
+}
@@ -0,0 +1,292 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Encrypted objects are split into chunks that are sealed separately with AES-256-GCM, so they can be
+// written and read as streams. The object starts with a random nonce prefix, and each chunk's nonce is
+// the prefix followed by the chunk's index and a flag marking the last chunk. Chunks can't be reordered,
+// dropped or truncated without failing authentication.
+const (
+	encryptionChunkSize   = 64 * 1024
+	encryptionKeySize     = 32
+	encryptionPrefixSize  = 7
+	encryptionLastChunk   = 1
+	encryptionCounterSize = 4
+)
+
+// ErrDecryptionFailed is returned when an encrypted object was modified or can't be decrypted with its key.
+var ErrDecryptionFailed = errors.New("object decryption failed")
+
+// Keyring looks up the encryption keys held in Kubernetes Secrets in the Velero namespace.
+// Each entry in a Secret is a key, named by its key ID. Keys are rotated by adding an entry with a new ID,
+// so a key ID always refers to the same key and keys are cached once they are found.
+type Keyring struct {
+	clientset kubernetes.Interface
+	namespace string
+
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// NewKeyring returns a Keyring for the Secrets in namespace.
+func NewKeyring(clientset kubernetes.Interface, namespace string) *Keyring {
+	return &Keyring{
+		clientset: clientset,
+		namespace: namespace,
+		keys:      make(map[string][]byte),
+	}
+}
+
+// key returns the key with keyID from the Secret secretName.
+func (k *Keyring) key(secretName, keyID string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	cacheKey := secretName + "/" + keyID
+	if key, ok := k.keys[cacheKey]; ok {
+		return key, nil
+	}
+
+	keys, err := k.readSecret(secretName)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, errors.Errorf("encryption key %q not found in secret %s", keyID, secretName)
+	}
+
+	k.keys[cacheKey] = key
+	return key, nil
+}
+
+// activeKeyID returns the ID of the key in the Secret secretName that new objects are encrypted with.
+// If keyID is not set the Secret must hold exactly one key.
+func (k *Keyring) activeKeyID(secretName, keyID string) (string, error) {
+	if keyID != "" {
+		if _, err := k.key(secretName, keyID); err != nil {
+			return "", err
+		}
+		return keyID, nil
+	}
+
+	keys, err := k.readSecret(secretName)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) != 1 {
+		ids := make([]string, 0, len(keys))
+		for id := range keys {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return "", errors.Errorf("secret %s holds %d encryption keys %v, the key to use must be set with encryptionKeyId", secretName, len(keys), ids)
+	}
+	for id := range keys {
+		return id, nil
+	}
+	return "", nil
+}
+
+// readSecret returns all the keys in the Secret secretName by key ID.
+// Keys can be stored either as 32 raw bytes or base64 encoded.
+func (k *Keyring) readSecret(secretName string) (map[string][]byte, error) {
+	secret, err := k.clientset.CoreV1().Secrets(k.namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get encryption key secret %s", secretName)
+	}
+
+	keys := make(map[string][]byte, len(secret.Data))
+	for id, data := range secret.Data {
+		key := data
+		if len(key) != encryptionKeySize {
+			decoded, err := base64.StdEncoding.DecodeString(string(data))
+			if err != nil || len(decoded) != encryptionKeySize {
+				return nil, errors.Errorf("encryption key %q in secret %s must be %d bytes", id, secretName, encryptionKeySize)
+			}
+			key = decoded
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// newChunkCipher returns the AES-256-GCM cipher for key.
+func newChunkCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce for chunk number counter of an object.
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, encryptionPrefixSize+encryptionCounterSize+1)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, encryptionLastChunk)
+	}
+	return append(nonce, 0)
+}
+
+// encryptReader returns a reader of everything read from src encrypted with key.
+// Closing it also closes src.
+func encryptReader(src io.ReadCloser, key []byte) (io.ReadCloser, error) {
+	aead, err := newChunkCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pipeThrough(src, func(w io.Writer) (io.WriteCloser, error) {
+		prefix := make([]byte, encryptionPrefixSize)
+		if _, err := rand.Read(prefix); err != nil {
+			return nil, errors.Wrap(err, "failed to generate nonce")
+		}
+		return &encryptingWriter{w: w, aead: aead, prefix: prefix}, nil
+	})
+}
+
+// encryptingWriter seals everything written to it in chunks. The last chunk is only sealed on Close.
+type encryptingWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	started bool
+	buf     []byte
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	// Keep at least one byte back, the last chunk is only known once the writer is closed
+	for len(e.buf) > encryptionChunkSize {
+		if err := e.seal(e.buf[:encryptionChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = append(e.buf[:0], e.buf[encryptionChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+func (e *encryptingWriter) seal(chunk []byte, last bool) error {
+	if !e.started {
+		if _, err := e.w.Write(e.prefix); err != nil {
+			return err
+		}
+		e.started = true
+	}
+	if e.counter == math.MaxUint32 {
+		return errors.New("object is too large to encrypt")
+	}
+
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.counter, last), chunk, nil)
+	e.counter++
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReadCloser returns the decrypted contents of an object encrypted with key.
+// Closing it also closes rc.
+func decryptReadCloser(rc io.ReadCloser, key []byte) (io.ReadCloser, error) {
+	aead, err := newChunkCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptingReadCloser{
+		r:      bufio.NewReader(rc),
+		closer: rc,
+		aead:   aead,
+		chunk:  make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+type decryptingReadCloser struct {
+	r       *bufio.Reader
+	closer  io.Closer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	chunk   []byte
+	buf     []byte
+	done    bool
+}
+
+func (d *decryptingReadCloser) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (d *decryptingReadCloser) open() error {
+	if d.prefix == nil {
+		prefix := make([]byte, encryptionPrefixSize)
+		if _, err := io.ReadFull(d.r, prefix); err != nil {
+			return errors.Wrap(ErrDecryptionFailed, "object is truncated")
+		}
+		d.prefix = prefix
+	}
+
+	n, err := io.ReadFull(d.r, d.chunk)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err == io.EOF:
+		return errors.Wrap(ErrDecryptionFailed, "object is truncated")
+	case err != nil:
+		return err
+	default:
+		// A full chunk is the last one if nothing follows it
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plaintext, err := d.aead.Open(d.chunk[:0], chunkNonce(d.prefix, d.counter, last), d.chunk[:n], nil)
+	if err != nil {
+		return errors.Wrapf(ErrDecryptionFailed, "chunk %d failed authentication", d.counter)
+	}
+	d.counter++
+	d.buf = plaintext
+	d.done = last
+	return nil
+}
+
+func (d *decryptingReadCloser) Close() error {
+	return d.closer.Close()
+}
@@ -0,0 +1,197 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_encryptReader_decryptReadCloser(t *testing.T) {
+	key := make([]byte, encryptionKeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		size   int
+		tamper func(data []byte) []byte
+	}{
+		{
+			name: "empty object",
+			size: 0,
+		},
+		{
+			name: "smaller than a chunk",
+			size: 100,
+		},
+		{
+			name: "exactly one chunk",
+			size: encryptionChunkSize,
+		},
+		{
+			name: "several chunks",
+			size: 3*encryptionChunkSize + 1,
+		},
+		{
+			name: "flipped bit",
+			size: 100,
+			tamper: func(data []byte) []byte {
+				data[len(data)/2] ^= 1
+				return data
+			},
+		},
+		{
+			name: "last chunk dropped",
+			size: 2*encryptionChunkSize + 10,
+			tamper: func(data []byte) []byte {
+				return data[:encryptionPrefixSize+2*(encryptionChunkSize+16)]
+			},
+		},
+		{
+			name: "truncated to a full chunk",
+			size: encryptionChunkSize + 10,
+			tamper: func(data []byte) []byte {
+				return data[:encryptionPrefixSize+encryptionChunkSize+16]
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := make([]byte, tt.size)
+			_, err := rand.Read(plaintext)
+			require.NoError(t, err)
+
+			encrypted, err := encryptReader(io.NopCloser(bytes.NewReader(plaintext)), key)
+			require.NoError(t, err)
+			ciphertext, err := io.ReadAll(encrypted)
+			require.NoError(t, err)
+			require.NoError(t, encrypted.Close())
+
+			if tt.tamper != nil {
+				ciphertext = tt.tamper(ciphertext)
+			}
+
+			decrypted, err := decryptReadCloser(io.NopCloser(bytes.NewReader(ciphertext)), key)
+			require.NoError(t, err)
+			got, err := io.ReadAll(decrypted)
+			if tt.tamper != nil {
+				require.ErrorIs(t, err, ErrDecryptionFailed)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, plaintext, got)
+		})
+	}
+}
+
+func Test_Encryption_KeyRotation(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "lvp-keys", Namespace: "velero"},
+		Data: map[string][]byte{
+			"key-1": bytes.Repeat([]byte{1}, encryptionKeySize),
+		},
+	}
+	clientset := fake.NewSimpleClientset(secret)
+	o.opts = &localVolumeObjectStoreOpts{}
+	o.keys = NewKeyring(clientset, "velero")
+
+	require.NoError(t, o.initEncryption(&bslConfig{encryptionKeySecret: "lvp-keys"}))
+	require.Equal(t, "key-1", o.encoding.EncryptionKeyID)
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader(`{"kind":"Backup"}`)))
+
+	stored, err := os.ReadFile(filepath.Join(root, "bucket", "backups/b1/velero-backup.json"))
+	require.NoError(t, err)
+	require.NotContains(t, string(stored), "Backup")
+
+	// Rotate to a new key, the old object is still readable
+	secret.Data["key-2"] = []byte("AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI=")
+	_, err = clientset.CoreV1().Secrets("velero").Update(t.Context(), secret, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.Error(t, o.initEncryption(&bslConfig{encryptionKeySecret: "lvp-keys"}), "the key must be chosen when there are several")
+	require.NoError(t, o.initEncryption(&bslConfig{encryptionKeySecret: "lvp-keys", encryptionKeyID: "key-2"}))
+	require.NoError(t, o.PutObject("bucket", "backups/b2/velero-backup.json", strings.NewReader(`{"kind":"Backup","name":"b2"}`)))
+
+	for key, want := range map[string]string{
+		"backups/b1/velero-backup.json": `{"kind":"Backup"}`,
+		"backups/b2/velero-backup.json": `{"kind":"Backup","name":"b2"}`,
+	} {
+		rc, err := o.GetObject("bucket", key)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, want, string(got))
+	}
+
+	// The fileserver decrypts the same way
+	rc, err := OpenObject(root, "/bucket/backups/b2/velero-backup.json", NewKeyring(clientset, "velero"))
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, `{"kind":"Backup","name":"b2"}`, string(got))
+}
+
+func Test_Encryption_KeyedChecksum(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "lvp-keys", Namespace: "velero"},
+		Data: map[string][]byte{
+			"key-1": bytes.Repeat([]byte{1}, encryptionKeySize),
+		},
+	}
+	o.opts = &localVolumeObjectStoreOpts{}
+	o.keys = NewKeyring(fake.NewSimpleClientset(secret), "velero")
+	require.NoError(t, o.initEncryption(&bslConfig{encryptionKeySecret: "lvp-keys"}))
+
+	const contents = `{"kind":"Backup"}`
+	key := "backups/b1/velero-backup.json"
+	path := filepath.Join(root, "bucket", key)
+	require.NoError(t, o.PutObject("bucket", key, strings.NewReader(contents)))
+
+	// The metadata doesn't give away the checksum of the contents
+	md, err := readObjectMetadata(path)
+	require.NoError(t, err)
+	require.True(t, md.KeyedChecksum)
+	plain := sha256.Sum256([]byte(contents))
+	require.NotEqual(t, hex.EncodeToString(plain[:]), md.SHA256)
+
+	rc, err := o.GetObject("bucket", key)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, contents, string(got))
+
+	// A tampered checksum fails verification
+	md.SHA256 = hex.EncodeToString(plain[:])
+	require.NoError(t, writeObjectMetadata(path, md))
+	rc, err = o.GetObject("bucket", key)
+	require.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.NoError(t, rc.Close())
+
+	// Objects encrypted by older versions have a plain checksum
+	md.KeyedChecksum = false
+	require.NoError(t, writeObjectMetadata(path, md))
+	rc, err = o.GetObject("bucket", key)
+	require.NoError(t, err)
+	got, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, contents, string(got))
+}
@@ -1,13 +1,33 @@
 package plugin
 
 import (
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// tempFilePrefix marks files that are still being written by PutObject.
+// They are renamed to their final name once the upload is complete.
+const tempFilePrefix = internalFilePrefix + "tmp."
+
+// staleTempFileAge is how long a temporary file can go without being written to
+// before it is considered abandoned by an interrupted upload.
+const staleTempFileAge = time.Hour
+
+// repositoryDirectories are managed directly by restic/kopia instead of through the object store,
+// so they never contain temporary files from PutObject and can be very large.
+var repositoryDirectories = []string{"restic", "kopia"}
+
 // ensureFilesystem checks that the filesystem is ready for use by the plugin
 // and that the plugin's directory structure is in place.
 func ensureFilesystem(path, prefix string, log *logrus.Entry) error {
@@ -37,3 +57,437 @@ func ensureFilesystem(path, prefix string, log *logrus.Entry) error {
 
 	return nil
 }
+
+// pruneEmptyDirs removes dir and each of its parents that are left empty, up to the root of the bucket
+// at bucketPath, or of the prefix if dir is under it. The directories Velero expects are always kept,
+// except under internal directories such as the one holding previous versions.
+func pruneEmptyDirs(bucketPath, prefix, dir string, log *logrus.Entry) error {
+	root := filepath.Join(bucketPath, prefix)
+	if !strings.HasPrefix(dir, root+string(filepath.Separator)) || !strings.HasPrefix(root, bucketPath) {
+		root = bucketPath
+	}
+	keep := make(map[string]bool)
+	if !isInternalName(filepath.Base(root)) {
+		for _, subdir := range getSubDirectoryLayout() {
+			keep[filepath.Join(root, subdir)] = true
+		}
+	}
+
+	removed := false
+	for ; strings.HasPrefix(dir, root+string(filepath.Separator)) && !keep[dir]; dir = filepath.Dir(dir) {
+		err := os.Remove(dir)
+		if err == nil {
+			log.WithField("dir", dir).Debug("Removed empty directory")
+			removed = true
+			continue
+		}
+		// Already removed by someone else, so its parent may be empty now too
+		if os.IsNotExist(err) {
+			continue
+		}
+		if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+			break
+		}
+		return errors.Wrapf(err, "failed to remove empty directory %s", dir)
+	}
+	if !removed {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+// stagedFile is a fully written temporary file that is waiting to be renamed into place.
+type stagedFile struct {
+	path     string
+	tempPath string
+	size     int64
+	// parts are the part files of an object split into chunks, the staged file itself is then their manifest.
+	parts []*stagedFile
+}
+
+// stageFile writes body to a temporary file in the same directory as path and syncs it to disk.
+// The caller must either Commit or Abort the staged file.
+func stageFile(path string, body io.Reader) (*stagedFile, error) {
+	file, err := createTempFile(filepath.Dir(path), tempFilePrefix+filepath.Base(path)+".")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temporary file")
+	}
+	staged := &stagedFile{path: path, tempPath: file.Name()}
+
+	err = func() error {
+		defer file.Close()
+
+		n, err := io.Copy(file, body)
+		if err != nil {
+			return errors.Wrap(err, "failed to write temporary file")
+		}
+		staged.size = n
+		if err := file.Sync(); err != nil {
+			return errors.Wrap(err, "failed to sync temporary file")
+		}
+		return file.Close()
+	}()
+	if err != nil {
+		staged.Abort()
+		return nil, err
+	}
+
+	return staged, nil
+}
+
+// createTempFile creates a new file in dir whose name starts with prefix. Unlike os.CreateTemp, the file is
+// created with the same permissions os.Create would give it, so the process umask still applies.
+func createTempFile(dir, prefix string) (*os.File, error) {
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, err
+	}
+	return nil, errors.Errorf("could not find an unused temporary file name in %s", dir)
+}
+
+// createDirs creates dir and any missing parents like os.MkdirAll, then syncs each new directory
+// into its parent so that a crash can't lose the directories along with the object written into them.
+func createDirs(dir string) error {
+	var created []string
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := os.Stat(p); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		created = append(created, p)
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, p := range created {
+		if err := syncDir(filepath.Dir(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit renames the staged file to its final path.
+func (s *stagedFile) Commit() error {
+	if len(s.parts) > 0 {
+		if err := s.commitParts(); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(s.tempPath, s.path); err != nil {
+		s.Abort()
+		for _, part := range s.parts {
+			os.Remove(part.path)
+		}
+		return errors.Wrap(err, "failed to rename temporary file")
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+// commitParts puts the part files in place ahead of their manifest.
+func (s *stagedFile) commitParts() error {
+	now := time.Now()
+	for i, part := range s.parts {
+		// Parts that are older than the manifest would be taken for orphans until it is in place
+		os.Chtimes(part.tempPath, now, now)
+		if err := os.Rename(part.tempPath, part.path); err != nil {
+			for _, committed := range s.parts[:i] {
+				os.Remove(committed.path)
+			}
+			s.Abort()
+			return errors.Wrap(err, "failed to rename temporary file")
+		}
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+// Abort removes the staged file.
+func (s *stagedFile) Abort() {
+	for _, part := range s.parts {
+		part.Abort()
+	}
+	if s.tempPath != "" {
+		os.Remove(s.tempPath)
+	}
+}
+
+// writeFileAtomic writes body to path by staging it in a temporary file in the same directory,
+// syncing it to disk and renaming it into place. Readers see either the previous file or the complete new one.
+func writeFileAtomic(path string, body io.Reader) error {
+	staged, err := stageFile(path, body)
+	if err != nil {
+		return err
+	}
+	return staged.Commit()
+}
+
+// syncDir flushes directory entries (creates, renames, removes) in dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to open directory")
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		// Some filesystems do not support syncing directories
+		if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTSUP) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to sync directory")
+	}
+	return nil
+}
+
+// removeStaleFiles removes temporary files left behind by uploads that were interrupted
+// before they could be renamed into place, and metadata whose object no longer exists.
+func removeStaleFiles(path string, log *logrus.Entry) error {
+	cutoff := time.Now().Add(-staleTempFileAge)
+
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() {
+			if p != path && (isInternalName(d.Name()) || (filepath.Dir(p) == path && (sliceContainsString(directoryDenyList, d.Name()) || sliceContainsString(repositoryDirectories, d.Name())))) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), metadataFilePrefix) {
+			return removeOrphanedMetadata(p, log)
+		}
+		if strings.HasPrefix(d.Name(), partFilePrefix) {
+			info, err := d.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			return removeOrphanedPart(p, info, log)
+		}
+		if !strings.HasPrefix(d.Name(), tempFilePrefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Uploads still in progress keep updating the modification time
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		log.Infof("Removing stale temporary file %s", p)
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "could not remove %s", p)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// splitPrefix splits an object store prefix into the directory it refers to and the partial name
+// that entries in that directory must start with, e.g. "backups/nightly-" becomes "backups/" and "nightly-".
+func splitPrefix(prefix string) (dir, namePrefix string) {
+	i := strings.LastIndex(prefix, "/")
+	return prefix[:i+1], prefix[i+1:]
+}
+
+// skipEntry returns truthy for the entry d at p in the bucket at bucketPath if it must never be reported to Velero.
+// The deny list only applies at the root of the bucket, anywhere else the names are those of backups or objects.
+func skipEntry(bucketPath, p string, d fs.DirEntry) bool {
+	if isInternalName(d.Name()) {
+		return true
+	}
+	return d.IsDir() && filepath.Dir(p) == filepath.Clean(bucketPath) && sliceContainsString(directoryDenyList, d.Name())
+}
+
+// listObjectKeys walks the tree under prefix in the bucket at bucketPath and returns the keys of
+// all regular files, in sorted order. Like other object stores, a missing prefix has no objects.
+// The directories it reads are recorded in deps.
+func listObjectKeys(bucketPath, prefix string, deps fileVersions) ([]string, error) {
+	dir, namePrefix := splitPrefix(prefix)
+	dirPath := filepath.Join(bucketPath, dir)
+
+	if err := deps.record(dirPath); err != nil {
+		return nil, err
+	}
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, dirEntry := range dirEntries {
+		if !strings.HasPrefix(dirEntry.Name(), namePrefix) || skipEntry(bucketPath, filepath.Join(dirPath, dirEntry.Name()), dirEntry) {
+			continue
+		}
+
+		if dirEntry.Type().IsRegular() {
+			keys = append(keys, dir+dirEntry.Name())
+			continue
+		}
+		if !dirEntry.IsDir() {
+			continue
+		}
+
+		err := filepath.WalkDir(filepath.Join(dirPath, dirEntry.Name()), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// removed while walking
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if skipEntry(bucketPath, p, d) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				return deps.record(p)
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(dirPath, p)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, dir+filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list objects in %s", dirEntry.Name())
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// containsObject returns truthy if there's at least one object anywhere in the tree under dirPath.
+// The directories it reads are recorded in deps.
+func containsObject(bucketPath, dirPath string, deps fileVersions) (bool, error) {
+	found := false
+	err := filepath.WalkDir(dirPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// removed while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if p != dirPath && skipEntry(bucketPath, p, d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			found = true
+			return filepath.SkipAll
+		}
+		if d.IsDir() {
+			return deps.record(p)
+		}
+		return nil
+	})
+	return found, err
+}
+
+// listCommonPrefixes groups the keys under prefix in the bucket at bucketPath by the first occurrence
+// of delimiter after prefix, the same way S3 does, and returns the distinct groups in sorted order.
+// The directories it reads are recorded in deps.
+func listCommonPrefixes(bucketPath, prefix, delimiter string, deps fileVersions) ([]string, error) {
+	if delimiter == "" {
+		return []string{}, nil
+	}
+
+	// With the path separator as the delimiter the common prefixes are the matching directories
+	// that hold at least one object, so there's no need to collect every key.
+	if delimiter == "/" {
+		dir, namePrefix := splitPrefix(prefix)
+
+		if err := deps.record(filepath.Join(bucketPath, dir)); err != nil {
+			return nil, err
+		}
+		dirEntries, err := os.ReadDir(filepath.Join(bucketPath, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return []string{}, nil
+			}
+			return nil, err
+		}
+
+		prefixes := []string{}
+		for _, dirEntry := range dirEntries {
+			dirPath := filepath.Join(bucketPath, dir, dirEntry.Name())
+			if !dirEntry.IsDir() || !strings.HasPrefix(dirEntry.Name(), namePrefix) || skipEntry(bucketPath, dirPath, dirEntry) {
+				continue
+			}
+
+			hasObjects, err := containsObject(bucketPath, dirPath, deps)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to list objects in %s", dirEntry.Name())
+			}
+			if hasObjects {
+				prefixes = append(prefixes, dir+dirEntry.Name()+delimiter)
+			}
+		}
+		return prefixes, nil
+	}
+
+	keys, err := listObjectKeys(bucketPath, prefix, deps)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	prefixes := []string{}
+	for _, key := range keys {
+		afterPrefix := key[len(prefix):]
+		i := strings.Index(afterPrefix, delimiter)
+		if i == -1 {
+			continue
+		}
+
+		commonPrefix := prefix + afterPrefix[:i+len(delimiter)]
+		if !seen[commonPrefix] {
+			seen[commonPrefix] = true
+			prefixes = append(prefixes, commonPrefix)
+		}
+	}
+
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
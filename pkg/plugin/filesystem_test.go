@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_writeFileAtomic(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		body     string
+	}{
+		{
+			name: "new file",
+			body: "new contents",
+		},
+		{
+			name:     "overwrite existing file",
+			existing: "some much longer previous contents",
+			body:     "new contents",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "velero-backup.json")
+			if tt.existing != "" {
+				require.NoError(t, os.WriteFile(path, []byte(tt.existing), 0644))
+			}
+
+			err := writeFileAtomic(path, strings.NewReader(tt.body))
+			require.NoError(t, err)
+
+			got, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.Equal(t, tt.body, string(got))
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Len(t, entries, 1, "temporary file was left behind")
+		})
+	}
+}
+
+func Test_stageFile_respectsUmask(t *testing.T) {
+	oldMask := syscall.Umask(027)
+	defer syscall.Umask(oldMask)
+
+	path := filepath.Join(t.TempDir(), "velero-backup.json")
+	require.NoError(t, writeFileAtomic(path, strings.NewReader("{}")))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+}
+
+func Test_createDirs(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "backups"), 0755))
+
+	dir := filepath.Join(root, "backups", "b1", "nested")
+	require.NoError(t, createDirs(dir))
+	require.DirExists(t, dir)
+
+	// existing directories are left alone
+	require.NoError(t, createDirs(dir))
+}
+
+func Test_removeStaleFiles(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-2 * staleTempFileAge)
+
+	files := map[string]bool{
+		// path: should be removed
+		"backups/b1/velero-backup.json":                             false,
+		"backups/b1/" + tempFilePrefix + "b1.tar.gz.123":            true,
+		"backups/b2/" + tempFilePrefix + "velero-backup.json.456":   false, // recently modified, still uploading
+		"restic/default/data/00/" + tempFilePrefix + "not-ours.789": false,
+		"backups/b1/" + metadataFilePrefix + "velero-backup.json":   false,
+		"backups/b1/" + metadataFilePrefix + "b1-logs.gz":           true, // object was deleted
+	}
+	for file, stale := range files {
+		path := filepath.Join(root, file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+		if stale || strings.HasPrefix(file, "restic") {
+			require.NoError(t, os.Chtimes(path, old, old))
+		}
+	}
+
+	err := removeStaleFiles(root, logrus.NewEntry(logrus.New()))
+	require.NoError(t, err)
+
+	for file, stale := range files {
+		_, err := os.Stat(filepath.Join(root, file))
+		if stale {
+			require.True(t, os.IsNotExist(err), "%s should have been removed", file)
+		} else {
+			require.NoError(t, err, "%s should not have been removed", file)
+		}
+	}
+}
+
+func Test_pruneEmptyDirs(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		dirs   []string
+		files  []string
+		prune  string
+		want   []string
+		gone   []string
+	}{
+		{
+			name:  "deep key",
+			dirs:  []string{"restic/default/data/ab"},
+			prune: "restic/default/data/ab",
+			want:  []string{"restic"},
+			gone:  []string{"restic/default"},
+		},
+		{
+			name:  "stops at a directory that still holds objects",
+			dirs:  []string{"backups/b1/sub"},
+			files: []string{"backups/b1/velero-backup.json"},
+			prune: "backups/b1/sub",
+			want:  []string{"backups/b1"},
+			gone:  []string{"backups/b1/sub"},
+		},
+		{
+			name:   "keeps the layout under the prefix",
+			prefix: "velero",
+			dirs:   []string{"velero/backups/b1"},
+			prune:  "velero/backups/b1",
+			want:   []string{"velero/backups"},
+			gone:   []string{"velero/backups/b1"},
+		},
+		{
+			name:   "keeps the prefix root",
+			prefix: "/velero",
+			dirs:   []string{"velero/other/b1"},
+			prune:  "velero/other/b1",
+			want:   []string{"velero"},
+			gone:   []string{"velero/other"},
+		},
+		{
+			name:  "already gone",
+			dirs:  []string{"backups"},
+			prune: "backups/b1/sub",
+			want:  []string{"backups"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucketPath := t.TempDir()
+			for _, dir := range test.dirs {
+				require.NoError(t, os.MkdirAll(filepath.Join(bucketPath, dir), 0755))
+			}
+			for _, file := range test.files {
+				require.NoError(t, os.WriteFile(filepath.Join(bucketPath, file), []byte("{}"), 0644))
+			}
+
+			err := pruneEmptyDirs(bucketPath, test.prefix, filepath.Join(bucketPath, test.prune), logrus.NewEntry(logrus.New()))
+			require.NoError(t, err)
+			for _, dir := range test.want {
+				require.DirExists(t, filepath.Join(bucketPath, dir))
+			}
+			for _, dir := range test.gone {
+				require.NoDirExists(t, filepath.Join(bucketPath, dir))
+			}
+			require.DirExists(t, bucketPath)
+		})
+	}
+}
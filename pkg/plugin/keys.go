@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// InvalidKeyError is returned when a bucket, key or prefix cannot be safely resolved to a path inside its bucket.
+type InvalidKeyError struct {
+	Bucket string
+	Key    string
+	Reason string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid key %q in bucket %q: %s", e.Key, e.Bucket, e.Reason)
+}
+
+// resolveBucket returns the path of a bucket under root.
+func resolveBucket(root, bucket string) (string, error) {
+	invalid := func(reason string) error {
+		return &InvalidKeyError{Bucket: bucket, Reason: reason}
+	}
+
+	switch {
+	case bucket == "" || bucket == "." || bucket == "..":
+		return "", invalid("bucket name is not valid")
+	case strings.ContainsAny(bucket, "/\x00"):
+		return "", invalid("bucket name must not contain '/' or NUL")
+	case isInternalName(bucket):
+		return "", invalid("bucket name is reserved for the plugin")
+	}
+
+	return filepath.Join(root, bucket), nil
+}
+
+// resolveKey returns the path of an object in a bucket under root. The key must be relative and stay inside
+// the bucket, both lexically and after following any symlinks on the way to it.
+// If allowEmpty is set the bucket itself can be resolved, which is needed for listing prefixes.
+func resolveKey(root, bucket, key string, allowEmpty bool) (string, error) {
+	bucketPath, err := resolveBucket(root, bucket)
+	if err != nil {
+		return "", err
+	}
+
+	invalid := func(reason string) error {
+		return &InvalidKeyError{Bucket: bucket, Key: key, Reason: reason}
+	}
+
+	if strings.Contains(key, "\x00") {
+		return "", invalid("key must not contain NUL")
+	}
+	if strings.HasPrefix(key, "/") {
+		return "", invalid("key must be relative to the bucket")
+	}
+
+	cleaned := path.Clean(key)
+	if cleaned == "." {
+		if !allowEmpty {
+			return "", invalid("key must not be empty")
+		}
+		return bucketPath, nil
+	}
+	if !filepath.IsLocal(cleaned) {
+		return "", invalid("key escapes the bucket")
+	}
+	if hasInternalName(cleaned) {
+		return "", invalid("key refers to a file reserved for the plugin")
+	}
+
+	objectPath := filepath.Join(bucketPath, cleaned)
+	if err := ensureInsideBucket(bucketPath, objectPath); err != nil {
+		return "", invalid(err.Error())
+	}
+
+	return objectPath, nil
+}
+
+// hasInternalName returns truthy if any part of a key is a name reserved for the plugin.
+func hasInternalName(key string) bool {
+	for _, part := range strings.Split(key, "/") {
+		if isInternalName(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureInsideBucket follows any symlinks in the existing part of p and ensures that it still
+// resolves to a location inside bucketPath.
+// The check is best-effort: the path is opened or removed again afterwards by name, so a symlink
+// planted by another client of a shared volume between the check and the use is still followed.
+func ensureInsideBucket(bucketPath, p string) error {
+	realBucketPath, err := filepath.EvalSymlinks(bucketPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// nothing inside the bucket can exist yet
+			return nil
+		}
+		return errors.Wrap(err, "failed to resolve bucket")
+	}
+
+	// Find the deepest part of the path that exists, anything below it can't be a symlink
+	existing := p
+	for {
+		realPath, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			rel, err := filepath.Rel(realBucketPath, realPath)
+			if err != nil || !filepath.IsLocal(rel) {
+				return errors.New("key follows a symlink outside of the bucket")
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to resolve symlinks")
+		}
+		if info, err := os.Lstat(existing); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("key follows a dangling symlink")
+		}
+
+		if existing == bucketPath {
+			return nil
+		}
+		existing = filepath.Dir(existing)
+	}
+}
+
+// bucketRelative allows keys under an absolute BSL prefix such as "/velero", as used in the examples.
+// Velero builds every key from that prefix, so those keys are relative to the bucket even though they
+// start with a slash. Any other key is returned unchanged.
+func (o *LocalVolumeObjectStore) bucketRelative(key string) string {
+	if !strings.HasPrefix(o.prefix, "/") {
+		return key
+	}
+
+	prefix := strings.TrimSuffix(o.prefix, "/") + "/"
+	if strings.HasPrefix(key, prefix) || key+"/" == prefix {
+		return strings.TrimLeft(key, "/")
+	}
+	return key
+}
+
+// objectPath resolves a key in a bucket to the path of the object.
+func (o *LocalVolumeObjectStore) objectPath(bucket, key string) (string, error) {
+	return resolveKey(getRoot(), bucket, o.bucketRelative(key), false)
+}
+
+// prefixPath validates a listing prefix and returns the path of the bucket it applies to.
+func (o *LocalVolumeObjectStore) prefixPath(bucket, prefix string) (string, error) {
+	dir, _ := splitPrefix(prefix)
+	if _, err := resolveKey(getRoot(), bucket, o.bucketRelative(dir), true); err != nil {
+		return "", err
+	}
+	return resolveBucket(getRoot(), bucket)
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_objectPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		bucket  string
+		key     string
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "simple key",
+			bucket: "bucket",
+			key:    "backups/b1/velero-backup.json",
+			want:   "bucket/backups/b1/velero-backup.json",
+		},
+		{
+			name:   "key is cleaned",
+			bucket: "bucket",
+			key:    "backups//b1/./velero-backup.json",
+			want:   "bucket/backups/b1/velero-backup.json",
+		},
+		{
+			name:   "dot dot that stays inside the bucket",
+			bucket: "bucket",
+			key:    "backups/b1/../b2/velero-backup.json",
+			want:   "bucket/backups/b2/velero-backup.json",
+		},
+		{
+			name:    "dot dot that escapes the bucket",
+			bucket:  "bucket",
+			key:     "backups/../../other-bucket/velero-backup.json",
+			wantErr: true,
+		},
+		{
+			name:    "absolute key",
+			bucket:  "bucket",
+			key:     "/etc/passwd",
+			wantErr: true,
+		},
+		{
+			name:   "key under an absolute bucket prefix",
+			bucket: "bucket",
+			prefix: "/velero",
+			key:    "/velero/backups/b1/velero-backup.json",
+			want:   "bucket/velero/backups/b1/velero-backup.json",
+		},
+		{
+			name:    "absolute key outside of the bucket prefix",
+			bucket:  "bucket",
+			prefix:  "/velero",
+			key:     "/etc/passwd",
+			wantErr: true,
+		},
+		{
+			name:    "empty key",
+			bucket:  "bucket",
+			key:     "",
+			wantErr: true,
+		},
+		{
+			name:    "key with plugin metadata",
+			bucket:  "bucket",
+			key:     "backups/b1/" + metadataFilePrefix + "velero-backup.json",
+			wantErr: true,
+		},
+		{
+			name:    "bucket escapes the root",
+			bucket:  "..",
+			key:     "etc/passwd",
+			wantErr: true,
+		},
+		{
+			name:    "bucket with a slash",
+			bucket:  "bucket/../../etc",
+			key:     "passwd",
+			wantErr: true,
+		},
+		{
+			name:   "symlink inside the bucket",
+			bucket: "bucket",
+			key:    "link-inside/velero-backup.json",
+			want:   "bucket/link-inside/velero-backup.json",
+		},
+		{
+			name:    "symlinked directory outside of the bucket",
+			bucket:  "bucket",
+			key:     "link-outside/passwd",
+			wantErr: true,
+		},
+		{
+			name:    "symlinked file outside of the bucket",
+			bucket:  "bucket",
+			key:     "backups/b1/link-to-file",
+			wantErr: true,
+		},
+		{
+			name:    "dangling symlink",
+			bucket:  "bucket",
+			key:     "link-dangling/velero-backup.json",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, root := newTestObjectStore(t, "bucket")
+			o.prefix = tt.prefix
+
+			outside := filepath.Join(root, "outside")
+			require.NoError(t, os.MkdirAll(outside, 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(outside, "passwd"), []byte("secret"), 0644))
+			require.NoError(t, os.MkdirAll(filepath.Join(root, "bucket", "backups", "b1"), 0755))
+			require.NoError(t, os.Symlink(filepath.Join(root, "bucket", "backups"), filepath.Join(root, "bucket", "link-inside")))
+			require.NoError(t, os.Symlink(outside, filepath.Join(root, "bucket", "link-outside")))
+			require.NoError(t, os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(root, "bucket", "backups", "b1", "link-to-file")))
+			require.NoError(t, os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "bucket", "link-dangling")))
+
+			got, err := o.objectPath(tt.bucket, tt.key)
+			if tt.wantErr {
+				var invalidKeyErr *InvalidKeyError
+				require.ErrorAs(t, err, &invalidKeyErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, filepath.Join(root, tt.want), got)
+		})
+	}
+}
+
+func Test_prefixPath(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	require.NoError(t, os.Symlink(t.TempDir(), filepath.Join(root, "bucket", "outside")))
+
+	_, err := o.ListObjects("bucket", "outside/")
+	var invalidKeyErr *InvalidKeyError
+	require.ErrorAs(t, err, &invalidKeyErr)
+
+	_, err = o.ListCommonPrefixes("bucket", "../", "/")
+	require.ErrorAs(t, err, &invalidKeyErr)
+
+	objects, err := o.ListObjects("bucket", "")
+	require.NoError(t, err)
+	require.Empty(t, objects, "symlinks are not objects")
+}
@@ -2,9 +2,11 @@ package plugin
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/pkg/errors"
@@ -25,6 +27,9 @@ type localVolumeObjectStoreOpts struct {
 	securityContextRunAsGroup string
 	securityContextFSGroup    string
 	preserveVolumes           map[string]bool
+	encryptionKeySecret       string
+	throttle                  throttleOpts
+	cache                     cacheOpts
 }
 
 const (
@@ -35,6 +40,10 @@ const (
 	ResticDaemonsetName    = "restic"
 
 	signingSecretName = "lvp-signingsecret"
+
+	// volumeNamesAnnotation on the Velero deployment maps each bucket to the name of its volume, as JSON,
+	// so that the volume is found again when the name of the volume for the bucket changes.
+	volumeNamesAnnotation = "replicated.com/local-volume-provider-volumes"
 )
 
 var (
@@ -47,7 +56,7 @@ type EnsureResourcesOpts struct {
 	bucket     string
 	prefix     string
 	path       string
-	config     map[string]string
+	config     *bslConfig
 	pluginOpts *localVolumeObjectStoreOpts
 	volumeType VolumeType
 	log        *logrus.Entry
@@ -66,6 +75,13 @@ func ensureResources(opts EnsureResourcesOpts) error {
 		return errors.Wrap(err, "could not get Velero deployment")
 	}
 
+	mirror := opts.config.mirror
+
+	volumeNames, err := getVolumeNames(deployment)
+	if err != nil {
+		return err
+	}
+
 	// if `preserveVolumes` is specified, clean up all other volumes and volume mounts
 	if len(opts.pluginOpts.preserveVolumes) > 0 {
 		if !opts.pluginOpts.preserveVolumes[opts.bucket] {
@@ -74,25 +90,74 @@ func ensureResources(opts EnsureResourcesOpts) error {
 			return nil
 		}
 
+		// the mirror of a preserved volume is preserved with it
+		preserveBuckets := opts.pluginOpts.preserveVolumes
+		if mirror != nil {
+			preserveBuckets = make(map[string]bool)
+			for bucket := range opts.pluginOpts.preserveVolumes {
+				preserveBuckets[bucket] = true
+			}
+			preserveBuckets[mirror.bucket] = true
+		}
+
+		// `preserveVolumes` lists buckets, and volumes added by earlier versions of the plugin are named after their bucket
+		preserveVolumes := make(map[string]bool)
+		for bucket := range preserveBuckets {
+			preserveVolumes[bucket] = true
+			if name, ok := volumeNames[bucket]; ok {
+				preserveVolumes[name] = true
+			}
+		}
+		for bucket := range volumeNames {
+			if !preserveBuckets[bucket] {
+				delete(volumeNames, bucket)
+			}
+		}
+
 		if ds != nil {
-			ds.Spec.Template.Spec.Volumes = removeUnusedVolumes(ds.Spec.Template.Spec.Volumes, opts.pluginOpts.preserveVolumes)
-			ds.Spec.Template.Spec.Containers[0].VolumeMounts = removeUnusedVolumeMounts(ds.Spec.Template.Spec.Containers[0].VolumeMounts, opts.pluginOpts.preserveVolumes)
+			ds.Spec.Template.Spec.Volumes = removeUnusedVolumes(ds.Spec.Template.Spec.Volumes, preserveVolumes)
+			ds.Spec.Template.Spec.Containers[0].VolumeMounts = removeUnusedVolumeMounts(ds.Spec.Template.Spec.Containers[0].VolumeMounts, preserveVolumes)
 		}
 
-		deployment.Spec.Template.Spec.Volumes = removeUnusedVolumes(deployment.Spec.Template.Spec.Volumes, opts.pluginOpts.preserveVolumes)
+		deployment.Spec.Template.Spec.Volumes = removeUnusedVolumes(deployment.Spec.Template.Spec.Volumes, preserveVolumes)
 		// remove unused mounts from all containers in the deployment
 		for idx := range deployment.Spec.Template.Spec.Containers {
 			container := &deployment.Spec.Template.Spec.Containers[idx]
-			container.VolumeMounts = removeUnusedVolumeMounts(container.VolumeMounts, opts.pluginOpts.preserveVolumes)
+			container.VolumeMounts = removeUnusedVolumeMounts(container.VolumeMounts, preserveVolumes)
 		}
 	}
 
-	volumeMountSpec := buildVolumeMount(opts.bucket, opts.path)
-
-	volumeSpec, err := buildVolume(opts.volumeType, opts.config, opts.log)
+	volumeSpec, err := buildVolume(opts.clientset, opts.namespace, opts.config.volume, ds != nil, opts.log)
 	if err != nil {
 		return errors.Wrap(err, "failed to build volume")
 	}
+	volumeMountSpec := buildVolumeMount(volumeSpec.Name, opts.path)
+
+	var mirrorVolumeSpec *corev1.Volume
+	var mirrorVolumeMountSpec *corev1.VolumeMount
+	if mirror != nil {
+		mirrorVolumeSpec, err = buildVolume(opts.clientset, opts.namespace, *mirror, ds != nil, opts.log)
+		if err != nil {
+			return errors.Wrap(err, "failed to build mirror volume")
+		}
+		mirrorVolumeMountSpec = buildVolumeMount(mirrorVolumeSpec.Name, filepath.Join(getRoot(), mirror.bucket))
+	}
+
+	// Volumes keep their mounts when they are renamed, so the pods see no difference beyond the name
+	migrateVolume := func(bucket, name string) {
+		if previous := previousVolumeName(&deployment.Spec.Template.Spec, volumeNames, bucket); previous != "" && previous != name {
+			opts.log.Infof("Renaming volume %s of bucket %s to %s", previous, bucket, name)
+			renameVolume(&deployment.Spec.Template.Spec, previous, name)
+			if ds != nil {
+				renameVolume(&ds.Spec.Template.Spec, previous, name)
+			}
+		}
+		volumeNames[bucket] = name
+	}
+	migrateVolume(opts.bucket, volumeSpec.Name)
+	if mirror != nil {
+		migrateVolume(mirror.bucket, mirrorVolumeSpec.Name)
+	}
 
 	if ds != nil {
 		// If node-agent is present, it must also mount the volume
@@ -100,6 +165,12 @@ func ensureResources(opts EnsureResourcesOpts) error {
 		if err != nil {
 			return errors.Wrap(err, "failed to ensure node-agent daemonset has volume")
 		}
+		if mirrorVolumeSpec != nil {
+			err = ensureDaemonsetHasVolume(ds, mirrorVolumeSpec, mirrorVolumeMountSpec)
+			if err != nil {
+				return errors.Wrap(err, "failed to ensure node-agent daemonset has mirror volume")
+			}
+		}
 
 		err = ensureDaemonsetHasConfig(ds, opts.pluginOpts)
 		if err != nil {
@@ -117,6 +188,12 @@ func ensureResources(opts EnsureResourcesOpts) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to ensure velero deployment has volume")
 	}
+	if mirrorVolumeSpec != nil {
+		err = ensureDeploymentHasVolume(deployment, mirrorVolumeSpec, mirrorVolumeMountSpec)
+		if err != nil {
+			return errors.Wrap(err, "failed to ensure velero deployment has mirror volume")
+		}
+	}
 
 	// Always update the deployment for new configmap setting and the fileserver,
 	// even if the local volume is already mounted.
@@ -125,6 +202,10 @@ func ensureResources(opts EnsureResourcesOpts) error {
 		return errors.Wrap(err, "could not ensure plugin configuration")
 	}
 
+	if err := setVolumeNames(deployment, volumeNames); err != nil {
+		return err
+	}
+
 	// Update Velero deployment
 	_, err = opts.clientset.AppsV1().Deployments(opts.namespace).Update(context.TODO(), deployment, metav1.UpdateOptions{})
 	if err != nil {
@@ -224,6 +305,81 @@ func ensureDaemonsetHasConfig(ds *appsv1.DaemonSet, opts *localVolumeObjectStore
 	return nil
 }
 
+// getVolumeNames returns the name of the volume of each bucket, as recorded on the Velero deployment.
+func getVolumeNames(deployment *appsv1.Deployment) (map[string]string, error) {
+	names := make(map[string]string)
+	if value := deployment.Annotations[volumeNamesAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &names); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s annotation of velero deployment", volumeNamesAnnotation)
+		}
+	}
+	return names, nil
+}
+
+// setVolumeNames records the name of the volume of each bucket on the Velero deployment.
+func setVolumeNames(deployment *appsv1.Deployment, names map[string]string) error {
+	value, err := json.Marshal(names)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode volume names")
+	}
+	if deployment.Annotations == nil {
+		deployment.Annotations = make(map[string]string)
+	}
+	deployment.Annotations[volumeNamesAnnotation] = string(value)
+	return nil
+}
+
+// previousVolumeName returns the name the volume of bucket has in the pod, as recorded in names or, for volumes
+// added by earlier versions of the plugin, the bucket itself. It returns "" if the bucket has no volume yet.
+func previousVolumeName(ps *corev1.PodSpec, names map[string]string, bucket string) string {
+	if name, ok := names[bucket]; ok {
+		return name
+	}
+	for _, name := range names {
+		if name == bucket {
+			// The volume named after the bucket belongs to another bucket
+			return ""
+		}
+	}
+	if exists, _ := podHasDuplicateVolumeName(ps, &corev1.Volume{Name: bucket}); exists {
+		return bucket
+	}
+	return ""
+}
+
+// renameVolume renames the volume oldName of a pod to newName along with its mounts in every container.
+// If the pod already has a volume named newName, the volume oldName is removed instead.
+func renameVolume(ps *corev1.PodSpec, oldName, newName string) {
+	exists, _ := podHasDuplicateVolumeName(ps, &corev1.Volume{Name: newName})
+
+	var volumes []corev1.Volume
+	for _, volume := range ps.Volumes {
+		if volume.Name == oldName {
+			if exists {
+				continue
+			}
+			volume.Name = newName
+		}
+		volumes = append(volumes, volume)
+	}
+	ps.Volumes = volumes
+
+	for idx := range ps.Containers {
+		container := &ps.Containers[idx]
+		var volumeMounts []corev1.VolumeMount
+		for _, volumeMount := range container.VolumeMounts {
+			if volumeMount.Name == oldName {
+				if containerHasVolumeMount(container, newName) {
+					continue
+				}
+				volumeMount.Name = newName
+			}
+			volumeMounts = append(volumeMounts, volumeMount)
+		}
+		container.VolumeMounts = volumeMounts
+	}
+}
+
 // removeUnusedVolumes removes volumes that are not specified in preserveVolumes
 func removeUnusedVolumes(volumes []corev1.Volume, preserveVolumes map[string]bool) []corev1.Volume {
 	var newVolumes []corev1.Volume
@@ -63,10 +63,8 @@ func Test_ensureResources(t *testing.T) {
 				bucket:    "my-bucket",
 				prefix:    "",
 				path:      "/var/velero-local-volume-provider/my-bucket",
-				config: map[string]string{
-					"bucket": "my-bucket",
-					"prefix": "",
-					"path":   "/backups",
+				config: &bslConfig{
+					volume: volumeConfig{volumeType: Hostpath, bucket: "my-bucket", path: "/backups"},
 				},
 				pluginOpts: &localVolumeObjectStoreOpts{},
 				volumeType: Hostpath,
@@ -94,7 +92,7 @@ func Test_ensureResources(t *testing.T) {
 											MountPath: "/plugins",
 										},
 										{
-											Name:      "my-bucket",
+											Name:      "hostpath-my-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-bucket",
 										},
 									},
@@ -106,7 +104,7 @@ func Test_ensureResources(t *testing.T) {
 									Env:     getLVPContainerEnv(),
 									VolumeMounts: []corev1.VolumeMount{
 										{
-											Name:      "my-bucket",
+											Name:      "hostpath-my-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-bucket",
 										},
 									},
@@ -120,7 +118,7 @@ func Test_ensureResources(t *testing.T) {
 									},
 								},
 								{
-									Name: "my-bucket",
+									Name: "hostpath-my-bucket",
 									VolumeSource: corev1.VolumeSource{
 										HostPath: &corev1.HostPathVolumeSource{
 											Path: "/backups",
@@ -202,10 +200,8 @@ func Test_ensureResources(t *testing.T) {
 				bucket:    "my-new-bucket",
 				prefix:    "",
 				path:      "/var/velero-local-volume-provider/my-new-bucket",
-				config: map[string]string{
-					"bucket": "my-new-bucket",
-					"prefix": "",
-					"path":   "/new-backups",
+				config: &bslConfig{
+					volume: volumeConfig{volumeType: Hostpath, bucket: "my-new-bucket", path: "/new-backups"},
 				},
 				pluginOpts: &localVolumeObjectStoreOpts{},
 				volumeType: Hostpath,
@@ -237,7 +233,7 @@ func Test_ensureResources(t *testing.T) {
 											MountPath: "/var/velero-local-volume-provider/my-bucket",
 										},
 										{
-											Name:      "my-new-bucket",
+											Name:      "hostpath-my-new-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-new-bucket",
 										},
 									},
@@ -253,7 +249,7 @@ func Test_ensureResources(t *testing.T) {
 											MountPath: "/var/velero-local-volume-provider/my-bucket",
 										},
 										{
-											Name:      "my-new-bucket",
+											Name:      "hostpath-my-new-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-new-bucket",
 										},
 									},
@@ -276,7 +272,7 @@ func Test_ensureResources(t *testing.T) {
 									},
 								},
 								{
-									Name: "my-new-bucket",
+									Name: "hostpath-my-new-bucket",
 									VolumeSource: corev1.VolumeSource{
 										HostPath: &corev1.HostPathVolumeSource{
 											Path: "/new-backups",
@@ -358,10 +354,8 @@ func Test_ensureResources(t *testing.T) {
 				bucket:    "my-new-bucket",
 				prefix:    "",
 				path:      "/var/velero-local-volume-provider/my-new-bucket",
-				config: map[string]string{
-					"bucket": "my-new-bucket",
-					"prefix": "",
-					"path":   "/new-backups",
+				config: &bslConfig{
+					volume: volumeConfig{volumeType: Hostpath, bucket: "my-new-bucket", path: "/new-backups"},
 				},
 				pluginOpts: &localVolumeObjectStoreOpts{
 					preserveVolumes: map[string]bool{
@@ -393,7 +387,7 @@ func Test_ensureResources(t *testing.T) {
 											MountPath: "/plugins",
 										},
 										{
-											Name:      "my-new-bucket",
+											Name:      "hostpath-my-new-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-new-bucket",
 										},
 									},
@@ -405,7 +399,7 @@ func Test_ensureResources(t *testing.T) {
 									Env:     getLVPContainerEnv(),
 									VolumeMounts: []corev1.VolumeMount{
 										{
-											Name:      "my-new-bucket",
+											Name:      "hostpath-my-new-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-new-bucket",
 										},
 									},
@@ -419,7 +413,7 @@ func Test_ensureResources(t *testing.T) {
 									},
 								},
 								{
-									Name: "my-new-bucket",
+									Name: "hostpath-my-new-bucket",
 									VolumeSource: corev1.VolumeSource{
 										HostPath: &corev1.HostPathVolumeSource{
 											Path: "/new-backups",
@@ -501,10 +495,8 @@ func Test_ensureResources(t *testing.T) {
 				bucket:    "my-new-bucket",
 				prefix:    "",
 				path:      "/var/velero-local-volume-provider/my-new-bucket",
-				config: map[string]string{
-					"bucket": "my-new-bucket",
-					"prefix": "",
-					"path":   "/new-backups",
+				config: &bslConfig{
+					volume: volumeConfig{volumeType: Hostpath, bucket: "my-new-bucket", path: "/new-backups"},
 				},
 				pluginOpts: &localVolumeObjectStoreOpts{
 					preserveVolumes: map[string]bool{
@@ -684,10 +676,8 @@ func Test_ensureResources(t *testing.T) {
 				bucket:    "my-bucket",
 				prefix:    "",
 				path:      "/var/velero-local-volume-provider/my-bucket",
-				config: map[string]string{
-					"bucket": "my-bucket",
-					"prefix": "",
-					"path":   "/backups",
+				config: &bslConfig{
+					volume: volumeConfig{volumeType: Hostpath, bucket: "my-bucket", path: "/backups"},
 				},
 				pluginOpts: &localVolumeObjectStoreOpts{
 					securityContextRunAsUser:  "1001",
@@ -719,7 +709,7 @@ func Test_ensureResources(t *testing.T) {
 											MountPath: "/plugins",
 										},
 										{
-											Name:      "my-bucket",
+											Name:      "hostpath-my-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-bucket",
 										},
 									},
@@ -731,7 +721,7 @@ func Test_ensureResources(t *testing.T) {
 									Env:     getLVPContainerEnv(),
 									VolumeMounts: []corev1.VolumeMount{
 										{
-											Name:      "my-bucket",
+											Name:      "hostpath-my-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-bucket",
 										},
 									},
@@ -745,7 +735,7 @@ func Test_ensureResources(t *testing.T) {
 									},
 								},
 								{
-									Name: "my-bucket",
+									Name: "hostpath-my-bucket",
 									VolumeSource: corev1.VolumeSource{
 										HostPath: &corev1.HostPathVolumeSource{
 											Path: "/backups",
@@ -780,7 +770,7 @@ func Test_ensureResources(t *testing.T) {
 									Name: "node-agent",
 									VolumeMounts: []corev1.VolumeMount{
 										{
-											Name:      "my-bucket",
+											Name:      "hostpath-my-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-bucket",
 										},
 									},
@@ -788,7 +778,7 @@ func Test_ensureResources(t *testing.T) {
 							},
 							Volumes: []corev1.Volume{
 								{
-									Name: "my-bucket",
+									Name: "hostpath-my-bucket",
 									VolumeSource: corev1.VolumeSource{
 										HostPath: &corev1.HostPathVolumeSource{
 											Path: "/backups",
@@ -915,10 +905,8 @@ func Test_ensureResources(t *testing.T) {
 				bucket:    "my-bucket",
 				prefix:    "",
 				path:      "/var/velero-local-volume-provider/my-bucket",
-				config: map[string]string{
-					"bucket": "my-bucket",
-					"prefix": "",
-					"path":   "/backups",
+				config: &bslConfig{
+					volume: volumeConfig{volumeType: Hostpath, bucket: "my-bucket", path: "/backups"},
 				},
 				pluginOpts: &localVolumeObjectStoreOpts{
 					securityContextRunAsUser:  "1001",
@@ -950,7 +938,7 @@ func Test_ensureResources(t *testing.T) {
 											MountPath: "/plugins",
 										},
 										{
-											Name:      "my-bucket",
+											Name:      "hostpath-my-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-bucket",
 										},
 									},
@@ -962,7 +950,7 @@ func Test_ensureResources(t *testing.T) {
 									Env:     getLVPContainerEnv(),
 									VolumeMounts: []corev1.VolumeMount{
 										{
-											Name:      "my-bucket",
+											Name:      "hostpath-my-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-bucket",
 										},
 									},
@@ -976,7 +964,7 @@ func Test_ensureResources(t *testing.T) {
 									},
 								},
 								{
-									Name: "my-bucket",
+									Name: "hostpath-my-bucket",
 									VolumeSource: corev1.VolumeSource{
 										HostPath: &corev1.HostPathVolumeSource{
 											Path: "/backups",
@@ -1011,7 +999,7 @@ func Test_ensureResources(t *testing.T) {
 									Name: "restic",
 									VolumeMounts: []corev1.VolumeMount{
 										{
-											Name:      "my-bucket",
+											Name:      "hostpath-my-bucket",
 											MountPath: "/var/velero-local-volume-provider/my-bucket",
 										},
 									},
@@ -1019,7 +1007,7 @@ func Test_ensureResources(t *testing.T) {
 							},
 							Volumes: []corev1.Volume{
 								{
-									Name: "my-bucket",
+									Name: "hostpath-my-bucket",
 									VolumeSource: corev1.VolumeSource{
 										HostPath: &corev1.HostPathVolumeSource{
 											Path: "/backups",
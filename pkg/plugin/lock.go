@@ -0,0 +1,241 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// lockDirName is the directory at the root of a bucket that holds the lock files used to coordinate
+// the Velero server and node-agent pods, which mount the same volume.
+const lockDirName = internalFilePrefix + "locks"
+
+// treeLockName is the lock on the directory tree of a bucket. Writers hold it shared so that
+// the directories they are writing into aren't removed by the cleanup after a delete, which holds it exclusively.
+const treeLockName = "tree"
+
+const (
+	// lockTimeout is how long to wait for a lock held by someone else.
+	lockTimeout = 5 * time.Minute
+	// lockFileHeartbeat is how often a held lock file is touched when the volume doesn't support flock.
+	lockFileHeartbeat = 30 * time.Second
+	// staleLockFileAge is how long a lock file can go without being touched before its holder is assumed to be dead.
+	staleLockFileAge = 5 * lockFileHeartbeat
+)
+
+// lockFileSuffix marks the lock files used instead of flock on volumes that don't support it, e.g. NFS mounted without a lock daemon.
+const lockFileSuffix = ".lockfile"
+
+// fileLock is a held lock. It is either a flock on an open file or, where flock is not supported,
+// a lock file created exclusively that is kept fresh until the lock is released.
+type fileLock struct {
+	file     *os.File
+	lockFile string
+	stop     chan struct{}
+}
+
+// lockKey takes an exclusive lock on key in the bucket at bucketPath. Keys are spread over 256 lock files
+// by the first byte of their hash so that the lock files don't grow with the number of keys,
+// keys that share a lock file are only ever serialized needlessly.
+func lockKey(bucketPath, key string, w *watchdog) (*fileLock, error) {
+	sum := sha256.Sum256([]byte(key))
+	name := fmt.Sprintf("key-%02x", sum[0])
+	lock, _, err := acquireLock(filepath.Join(bucketPath, lockDirName, name), true, true, w)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to lock %s", key)
+	}
+	return lock, nil
+}
+
+// lockTree takes a shared lock on the directory tree of the bucket at bucketPath.
+func lockTree(bucketPath string, w *watchdog) (*fileLock, error) {
+	lock, _, err := acquireLock(filepath.Join(bucketPath, lockDirName, treeLockName), false, true, w)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lock bucket directories")
+	}
+	return lock, nil
+}
+
+// tryLockTreeExclusive takes an exclusive lock on the directory tree of the bucket at bucketPath
+// if nothing else holds it, and returns falsy otherwise.
+func tryLockTreeExclusive(bucketPath string) (*fileLock, bool, error) {
+	return acquireLock(filepath.Join(bucketPath, lockDirName, treeLockName), true, false, nil)
+}
+
+// acquireLock takes a lock on path. If wait is set it waits for up to lockTimeout for the lock, otherwise
+// it returns falsy straight away if the lock is held. Time spent waiting doesn't count towards the timeout
+// of the operation w belongs to.
+func acquireLock(path string, exclusive, wait bool, w *watchdog) (*fileLock, bool, error) {
+	if err := createDirs(filepath.Dir(path)); err != nil {
+		return nil, false, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, false, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for delay := 10 * time.Millisecond; ; delay = nextLockDelay(delay) {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return &fileLock{file: file}, true, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			file.Close()
+			if errors.Is(err, syscall.ENOLCK) || errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+				return acquireLockFile(path, exclusive, wait, w)
+			}
+			return nil, false, err
+		}
+		if !wait || time.Now().After(deadline) {
+			file.Close()
+			if !wait {
+				return nil, false, nil
+			}
+			return nil, false, errors.Errorf("timed out after %s waiting for lock %s", lockTimeout, path)
+		}
+		w.sleep(delay)
+	}
+}
+
+// acquireLockFile takes a lock on path by creating a lock file next to it, which works on any filesystem
+// that creates files exclusively, including NFS. A shared lock is a lock file of its own in a directory
+// next to the exclusive lock file, so that holders of shared locks don't exclude each other.
+func acquireLockFile(path string, exclusive, wait bool, w *watchdog) (*fileLock, bool, error) {
+	exclusivePath := path + lockFileSuffix
+	sharedDir := path + ".shared"
+	if err := createDirs(sharedDir); err != nil {
+		return nil, false, err
+	}
+
+	lockFile := exclusivePath
+	if !exclusive {
+		lockFile = filepath.Join(sharedDir, fmt.Sprintf("%s-%d-%d", hostname(), os.Getpid(), time.Now().UnixNano()))
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	for delay := 10 * time.Millisecond; ; delay = nextLockDelay(delay) {
+		acquired, err := tryLockFile(lockFile, exclusivePath, sharedDir, exclusive)
+		if err != nil {
+			return nil, false, err
+		}
+		if acquired {
+			lock := &fileLock{lockFile: lockFile, stop: make(chan struct{})}
+			go lock.heartbeat()
+			return lock, true, nil
+		}
+		if !wait {
+			return nil, false, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, false, errors.Errorf("timed out after %s waiting for lock %s", lockTimeout, path)
+		}
+		w.sleep(delay)
+	}
+}
+
+// tryLockFile creates lockFile and checks that no conflicting lock is held, removing it again if one is.
+func tryLockFile(lockFile, exclusivePath, sharedDir string, exclusive bool) (bool, error) {
+	removeStaleLockFile(exclusivePath)
+	file, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	file.Close()
+
+	// Both kinds of lock file are created before checking for the other kind, so two conflicting
+	// holders can both back off but can't both succeed
+	conflict := false
+	if exclusive {
+		entries, err := os.ReadDir(sharedDir)
+		if err != nil {
+			os.Remove(lockFile)
+			return false, err
+		}
+		for _, entry := range entries {
+			if !removeStaleLockFile(filepath.Join(sharedDir, entry.Name())) {
+				conflict = true
+			}
+		}
+	} else {
+		if _, err := os.Stat(exclusivePath); err == nil {
+			conflict = true
+		} else if !os.IsNotExist(err) {
+			os.Remove(lockFile)
+			return false, err
+		}
+	}
+	if conflict {
+		os.Remove(lockFile)
+		return false, nil
+	}
+	return true, nil
+}
+
+// removeStaleLockFile removes the lock file at path if its holder stopped keeping it fresh,
+// and returns truthy if there is no lock file left.
+func removeStaleLockFile(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	if time.Since(info.ModTime()) < staleLockFileAge {
+		return false
+	}
+	err = os.Remove(path)
+	return err == nil || os.IsNotExist(err)
+}
+
+// heartbeat keeps the lock file fresh until the lock is released.
+func (l *fileLock) heartbeat() {
+	ticker := time.NewTicker(lockFileHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			os.Chtimes(l.lockFile, now, now)
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (l *fileLock) Unlock() {
+	if l.file != nil {
+		// Closing the file releases the flock
+		l.file.Close()
+		return
+	}
+	close(l.stop)
+	os.Remove(l.lockFile)
+}
+
+func nextLockDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay > time.Second {
+		return time.Second
+	}
+	return delay
+}
+
+// hostname identifies the pod holding a lock file.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_lockKey(t *testing.T) {
+	bucketPath := t.TempDir()
+
+	lock, err := lockKey(bucketPath, "backups/b1/b1.tar.gz", nil)
+	require.NoError(t, err)
+
+	lockDir := filepath.Join(bucketPath, lockDirName)
+	entries, err := os.ReadDir(lockDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	_, acquired, err := acquireLock(filepath.Join(lockDir, entries[0].Name()), true, false, nil)
+	require.NoError(t, err)
+	require.False(t, acquired, "the key is already locked")
+
+	lock.Unlock()
+	again, acquired, err := acquireLock(filepath.Join(lockDir, entries[0].Name()), true, false, nil)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	again.Unlock()
+}
+
+func Test_lockTree(t *testing.T) {
+	bucketPath := t.TempDir()
+
+	// Writers don't exclude each other
+	first, err := lockTree(bucketPath, nil)
+	require.NoError(t, err)
+	second, err := lockTree(bucketPath, nil)
+	require.NoError(t, err)
+
+	_, acquired, err := tryLockTreeExclusive(bucketPath)
+	require.NoError(t, err)
+	require.False(t, acquired)
+
+	first.Unlock()
+	second.Unlock()
+	cleanup, acquired, err := tryLockTreeExclusive(bucketPath)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	cleanup.Unlock()
+}
+
+func Test_acquireLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+
+	first, acquired, err := acquireLockFile(path, false, false, nil)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	second, acquired, err := acquireLockFile(path, false, false, nil)
+	require.NoError(t, err)
+	require.True(t, acquired, "shared locks don't exclude each other")
+
+	_, acquired, err = acquireLockFile(path, true, false, nil)
+	require.NoError(t, err)
+	require.False(t, acquired)
+
+	first.Unlock()
+	second.Unlock()
+	exclusive, acquired, err := acquireLockFile(path, true, false, nil)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	_, acquired, err = acquireLockFile(path, false, false, nil)
+	require.NoError(t, err)
+	require.False(t, acquired)
+
+	// The lock of a holder that died is taken over once it goes stale
+	exclusive.Unlock()
+	require.NoError(t, os.WriteFile(path+lockFileSuffix, nil, 0644))
+	old := time.Now().Add(-2 * staleLockFileAge)
+	require.NoError(t, os.Chtimes(path+lockFileSuffix, old, old))
+	taken, acquired, err := acquireLockFile(path, true, false, nil)
+	require.NoError(t, err)
+	require.True(t, acquired)
+	taken.Unlock()
+}
+
+func Test_DeleteObject_SkipsCleanupWhileWriting(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	bucketPath := filepath.Join(root, "bucket")
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("{}")))
+
+	writer, err := lockTree(bucketPath, nil)
+	require.NoError(t, err)
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/velero-backup.json"))
+	require.DirExists(t, filepath.Join(bucketPath, "backups/b1"), "a writer may be about to write into the directory")
+	writer.Unlock()
+
+	prefixes, err := o.ListCommonPrefixes("bucket", "", "/")
+	require.NoError(t, err)
+	require.NotContains(t, prefixes, lockDirName+"/")
+}
@@ -0,0 +1,305 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// internalFilePrefix is shared by all the files the plugin keeps next to objects for its own bookkeeping.
+// Anything starting with it is hidden from Velero.
+const internalFilePrefix = ".lvp-"
+
+// metadataFilePrefix marks the sidecar file that holds an object's metadata.
+const metadataFilePrefix = internalFilePrefix + "meta."
+
+// ErrChecksumMismatch is returned when an object no longer matches the checksum recorded when it was written.
+var ErrChecksumMismatch = errors.New("object checksum mismatch")
+
+// checksumKeyInfo separates the key encrypted objects are checksummed with from the key they are encrypted with.
+const checksumKeyInfo = "local-volume-provider object checksum"
+
+// objectMetadata is stored in a sidecar file next to each object.
+type objectMetadata struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	// KeyedChecksum is set if SHA256 is an HMAC-SHA256 keyed from the encryption key, so that the metadata of an
+	// encrypted object gives nothing away about its contents. Objects encrypted by older versions have a plain SHA-256.
+	KeyedChecksum bool `json:"keyedChecksum,omitempty"`
+	// objectEncoding is how the object is stored on the volume. SHA256 and Size are always for the decoded object.
+	objectEncoding
+	// StoredSize is the size of the object on the volume, if it's encoded.
+	StoredSize int64 `json:"storedSize,omitempty"`
+	// RetainUntil is set if the object was written with a retention period and can't be deleted or overwritten before then.
+	RetainUntil *time.Time `json:"retainUntil,omitempty"`
+	// Parts is the number of part files the object is split into, its own file is then a manifest of the parts.
+	Parts int `json:"parts,omitempty"`
+	// Blob is the sha256 of the object as stored if it is a link to a deduplicated blob.
+	Blob string `json:"blob,omitempty"`
+}
+
+// storedSize returns the size of the object on the volume.
+func (md *objectMetadata) storedSize() int64 {
+	if md.encoded() {
+		return md.StoredSize
+	}
+	return md.Size
+}
+
+// isInternalName returns truthy if a file or directory name belongs to the plugin rather than to an object.
+func isInternalName(name string) bool {
+	return strings.HasPrefix(name, internalFilePrefix)
+}
+
+// metadataPath returns the path of the sidecar metadata file for the object at path.
+func metadataPath(path string) string {
+	return filepath.Join(filepath.Dir(path), metadataFilePrefix+filepath.Base(path))
+}
+
+// readObjectMetadata returns the metadata for the object at path, or nil if the object
+// was written without it (e.g. by an older version of the plugin).
+func readObjectMetadata(path string) (*objectMetadata, error) {
+	data, err := os.ReadFile(metadataPath(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read object metadata")
+	}
+
+	md := &objectMetadata{}
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, errors.Wrap(err, "failed to parse object metadata")
+	}
+	return md, nil
+}
+
+// writeObjectMetadata atomically writes the metadata for the object at path.
+func writeObjectMetadata(path string, md *objectMetadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal object metadata")
+	}
+	if err := writeFileAtomic(metadataPath(path), bytes.NewReader(data)); err != nil {
+		return errors.Wrap(err, "failed to write object metadata")
+	}
+	return nil
+}
+
+// removeObjectMetadata removes the metadata for the object at path, if there is any.
+func removeObjectMetadata(path string) error {
+	if err := os.Remove(metadataPath(path)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove object metadata")
+	}
+	return nil
+}
+
+// removeOrphanedMetadata removes the metadata file at mdPath if the object it belongs to no longer exists.
+func removeOrphanedMetadata(mdPath string, log *logrus.Entry) error {
+	objectPath := filepath.Join(filepath.Dir(mdPath), strings.TrimPrefix(filepath.Base(mdPath), metadataFilePrefix))
+	if _, err := os.Lstat(objectPath); !os.IsNotExist(err) {
+		return nil
+	}
+
+	log.Infof("Removing orphaned metadata file %s", mdPath)
+	if err := os.Remove(mdPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "could not remove %s", mdPath)
+	}
+	return nil
+}
+
+// openObject opens the object at path and returns it along with its metadata, if there is any.
+// The metadata is read after the object is opened and the object is reopened once if their sizes disagree,
+// so that an overwrite in between doesn't pair the old metadata with the new object. If checkSize is set,
+// sizes that still disagree fail with ErrChecksumMismatch.
+func openObject(path string, checkSize bool) (io.ReadCloser, *objectMetadata, error) {
+	for attempt := 0; ; attempt++ {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		md, err := readObjectMetadata(path)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		if md == nil {
+			return file, nil, nil
+		}
+
+		var rc io.ReadCloser = file
+		var size int64
+		if md.Parts > 0 {
+			rc, size, err = openParts(file)
+			file.Close()
+			if err != nil {
+				// The parts of the previous object are removed once an overwrite is in place
+				if os.IsNotExist(err) && attempt == 0 {
+					continue
+				}
+				return nil, nil, err
+			}
+		} else {
+			info, err := file.Stat()
+			if err != nil {
+				file.Close()
+				return nil, nil, errors.Wrap(err, "failed to stat object")
+			}
+			size = info.Size()
+		}
+		// A size that still disagrees is left for verification to report, unless it is checked here
+		if size == md.storedSize() || (attempt > 0 && !checkSize) {
+			return rc, md, nil
+		}
+		rc.Close()
+		if attempt > 0 {
+			return nil, nil, errors.Wrapf(ErrChecksumMismatch, "object is %d bytes, its metadata says %d", size, md.storedSize())
+		}
+	}
+}
+
+// readObject opens the object at path for reading. It is decoded and verified against
+// its metadata, if there is any.
+func readObject(path string, keys *Keyring) (io.ReadCloser, error) {
+	return openVerifiedObject(path, keys, false)
+}
+
+// readSizedObject is like readObject, but fails with ErrChecksumMismatch straight away if the size of
+// the object on the volume disagrees with its metadata.
+func readSizedObject(path string, keys *Keyring) (io.ReadCloser, error) {
+	return openVerifiedObject(path, keys, true)
+}
+
+func openVerifiedObject(path string, keys *Keyring, checkSize bool) (io.ReadCloser, error) {
+	rc, md, err := openObject(path, checkSize)
+	if err != nil {
+		return nil, err
+	}
+	if md == nil {
+		return rc, nil
+	}
+
+	decoded, err := decodeReadCloser(rc, md.objectEncoding, keys)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	verified, err := newVerifyingReadCloser(decoded, path, md, keys)
+	if err != nil {
+		decoded.Close()
+		return nil, err
+	}
+	return verified, nil
+}
+
+// OpenObject opens an object for reading the same way GetObject does. The object is addressed by
+// a slash separated "<bucket>/<key>" path under root, as in the signed URLs served by the fileserver.
+// Encrypted objects are decrypted with keys from the keyring.
+func OpenObject(root, objectPath string, keys *Keyring) (io.ReadCloser, error) {
+	bucket, key, _ := strings.Cut(strings.TrimLeft(objectPath, "/"), "/")
+	// Keys under an absolute prefix keep their leading slash in signed URLs
+	path, err := resolveKey(root, bucket, strings.TrimLeft(key, "/"), false)
+	if err != nil {
+		return nil, err
+	}
+	return readObject(path, keys)
+}
+
+// checksumReader computes the SHA-256, or the HMAC-SHA256 if it is keyed, and size of everything read through it.
+type checksumReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	keyed  bool
+	size   int64
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{reader: r, hash: sha256.New()}
+}
+
+// newObjectChecksumReader returns a checksumReader for an object stored with encoding e. Encrypted objects
+// are checksummed with a key derived from their encryption key, otherwise the checksum would confirm
+// guesses about their contents and tell which encrypted objects are the same.
+func newObjectChecksumReader(r io.Reader, e objectEncoding, keys *Keyring) (*checksumReader, error) {
+	if !e.encrypted() {
+		return newChecksumReader(r), nil
+	}
+	key, err := keys.key(e.EncryptionKeySecret, e.EncryptionKeyID)
+	if err != nil {
+		return nil, err
+	}
+	checksumKey, err := hkdf.Key(sha256.New, key, nil, checksumKeyInfo, sha256.Size)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive checksum key")
+	}
+	return &checksumReader{reader: r, hash: hmac.New(sha256.New, checksumKey), keyed: true}, nil
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	return n, err
+}
+
+// metadata returns the object metadata for everything read so far.
+func (r *checksumReader) metadata() *objectMetadata {
+	return &objectMetadata{
+		SHA256:        hex.EncodeToString(r.hash.Sum(nil)),
+		Size:          r.size,
+		KeyedChecksum: r.keyed,
+	}
+}
+
+// verifyingReadCloser checks the object against its recorded metadata once it has been read to the end,
+// and fails the read if it does not match.
+type verifyingReadCloser struct {
+	*checksumReader
+	closer   io.Closer
+	path     string
+	expected *objectMetadata
+}
+
+func newVerifyingReadCloser(rc io.ReadCloser, path string, expected *objectMetadata, keys *Keyring) (*verifyingReadCloser, error) {
+	checksum := newChecksumReader(rc)
+	if expected.KeyedChecksum {
+		var err error
+		if checksum, err = newObjectChecksumReader(rc, expected.objectEncoding, keys); err != nil {
+			return nil, err
+		}
+	}
+	return &verifyingReadCloser{
+		checksumReader: checksum,
+		closer:         rc,
+		path:           path,
+		expected:       expected,
+	}, nil
+}
+
+func (r *verifyingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.checksumReader.Read(p)
+	if err == io.EOF {
+		if actual := r.metadata(); actual.SHA256 != r.expected.SHA256 || actual.Size != r.expected.Size {
+			return n, errors.Wrapf(ErrChecksumMismatch, "%s: expected sha256 %s (%d bytes), got %s (%d bytes)",
+				r.path, r.expected.SHA256, r.expected.Size, actual.SHA256, actual.Size)
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReadCloser) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,338 @@
+package plugin
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// mirrorConfigPrefix starts every BSL config key that configures the mirror volume, e.g. "mirrorPath".
+const mirrorConfigPrefix = "mirror"
+
+// MirrorDivergence is an object whose copies on the primary and the mirror volume differ.
+type MirrorDivergence struct {
+	Key    string
+	Reason string
+	// Repaired is set if the object was copied over the bad copy.
+	Repaired bool
+}
+
+// getMirrorConfig returns the volume type and the config for the mirror volume of a BSL, built from the
+// config keys that start with "mirror", e.g. "mirrorPath" becomes "path". The mirror has the same type as
+// the primary volume unless "mirrorType" is set, and is named after the bucket unless "mirrorBucket" is set.
+// It returns a nil config if no mirror is configured.
+func getMirrorConfig(vt VolumeType, config map[string]string) (VolumeType, map[string]string, error) {
+	mirrorConfig := make(map[string]string)
+	for key, value := range config {
+		if !strings.HasPrefix(key, mirrorConfigPrefix) || len(key) == len(mirrorConfigPrefix) {
+			continue
+		}
+		name := key[len(mirrorConfigPrefix):]
+		mirrorConfig[strings.ToLower(name[:1])+name[1:]] = value
+	}
+	if len(mirrorConfig) == 0 {
+		return "", nil, nil
+	}
+
+	mirrorType := vt
+	if t, ok := mirrorConfig["type"]; ok {
+		mirrorType = VolumeType(t)
+		delete(mirrorConfig, "type")
+	}
+	switch mirrorType {
+	case Hostpath, NFS, PVC, CSI:
+	default:
+		return "", nil, errors.Errorf("unsupported mirror volume type %q", mirrorType)
+	}
+
+	if mirrorConfig["bucket"] == "" {
+		mirrorConfig["bucket"] = config["bucket"] + "-mirror"
+	}
+	if mirrorConfig["bucket"] == config["bucket"] {
+		return "", nil, errors.New("the mirror must be a different bucket")
+	}
+	if _, err := resolveBucket(getRoot(), mirrorConfig["bucket"]); err != nil {
+		return "", nil, err
+	}
+	mirrorConfig["prefix"] = config["prefix"]
+
+	return mirrorType, mirrorConfig, nil
+}
+
+// copyObject copies the object at src to dst as it is stored, along with its metadata.
+// An object split into parts is copied into parts of the same size.
+func copyObject(src, dst string) error {
+	return throttledCopyObject(src, dst, nil, nil)
+}
+
+// throttledCopyObject is copyObject limited to the bandwidth of t, if it is set.
+func throttledCopyObject(src, dst string, t *bucketThrottle, w *watchdog) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	md, err := os.ReadFile(metadataPath(src))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read object metadata")
+	}
+
+	var stored io.Reader = file
+	var chunkSize int64
+	if parsed, err := readObjectMetadata(src); err != nil {
+		return err
+	} else if parsed != nil && parsed.Parts > 0 {
+		manifest, err := readChunkManifest(file, src)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		parts, _, err := openParts(file)
+		if err != nil {
+			return err
+		}
+		defer parts.Close()
+		stored, chunkSize = parts, manifest.Parts[0]
+	}
+
+	if err := createDirs(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	replaced, err := partsOf(dst)
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		stored = t.reader(stored, w)
+	}
+	staged, err := stageChunkedFile(dst, stored, chunkSize)
+	if err != nil {
+		return err
+	}
+
+	// Like PutObject, the metadata goes in place first since encoded objects can't be read without it
+	if md != nil {
+		err = writeFileAtomic(metadataPath(dst), bytes.NewReader(md))
+	} else {
+		err = removeObjectMetadata(dst)
+	}
+	if err != nil {
+		staged.Abort()
+		return err
+	}
+	if err := staged.Commit(); err != nil {
+		return err
+	}
+	return removeParts(replaced)
+}
+
+// verifyObject reads the object at path to the end to check it against its metadata.
+func verifyObject(path string, keys *Keyring) error {
+	rc, err := readObject(path, keys)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
+
+// isObjectDamaged returns truthy for errors reading an object that mean the copy is missing or bad,
+// rather than that it couldn't be read right now.
+func isObjectDamaged(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrDecryptionFailed)
+}
+
+// RepairMirror verifies every object under prefix in a bucket under the volume root and its copy
+// in mirrorBucket, and returns the objects whose copies differ. If repair is set, missing and bad copies
+// are replaced by the good copy.
+func RepairMirror(bucket, mirrorBucket, prefix string, repair bool, keys *Keyring, log logrus.FieldLogger) ([]MirrorDivergence, error) {
+	bucketPath, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return nil, err
+	}
+	mirrorPath, err := resolveBucket(getRoot(), mirrorBucket)
+	if err != nil {
+		return nil, err
+	}
+	dir, _ := splitPrefix(prefix)
+	if _, err := resolveKey(getRoot(), bucket, dir, true); err != nil {
+		return nil, err
+	}
+
+	primaryKeys, err := listObjectKeys(bucketPath, prefix, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list objects on the primary volume")
+	}
+	mirrorKeys, err := listObjectKeys(mirrorPath, prefix, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list objects on the mirror volume")
+	}
+
+	seen := make(map[string]bool)
+	allKeys := []string{}
+	for _, key := range append(primaryKeys, mirrorKeys...) {
+		if !seen[key] {
+			seen[key] = true
+			allKeys = append(allKeys, key)
+		}
+	}
+	sort.Strings(allKeys)
+
+	divergences := []MirrorDivergence{}
+	for _, key := range allKeys {
+		primary := filepath.Join(bucketPath, filepath.FromSlash(key))
+		mirror := filepath.Join(mirrorPath, filepath.FromSlash(key))
+
+		divergence, src, dst, err := compareCopies(key, primary, mirror, keys)
+		if err != nil {
+			return divergences, err
+		}
+		if divergence == nil {
+			continue
+		}
+
+		if repair && src != "" {
+			dstBucketPath := bucketPath
+			if dst == mirror {
+				dstBucketPath = mirrorPath
+			}
+			if err := repairCopy(dstBucketPath, key, src, dst); err != nil {
+				return divergences, errors.Wrapf(err, "failed to repair %s", key)
+			}
+			divergence.Repaired = true
+		}
+		log.WithField("key", key).Warnf("Mirror divergence: %s", divergence.Reason)
+		divergences = append(divergences, *divergence)
+	}
+	return divergences, nil
+}
+
+// repairCopy replaces the copy of key at dst, in the bucket at bucketPath, with the good copy at src.
+func repairCopy(bucketPath, key, src, dst string) error {
+	keyLock, err := lockKey(bucketPath, key, nil)
+	if err != nil {
+		return err
+	}
+	defer keyLock.Unlock()
+	treeLock, err := lockTree(bucketPath, nil)
+	if err != nil {
+		return err
+	}
+	defer treeLock.Unlock()
+
+	return copyObject(src, dst)
+}
+
+// compareCopies compares the copies of an object on the primary and the mirror volume. If they differ it
+// returns the divergence, and the good copy to repair the bad copy with if one of them is good.
+func compareCopies(key, primary, mirror string, keys *Keyring) (*MirrorDivergence, string, string, error) {
+	primaryMD, primaryErr := readCopyMetadata(primary)
+	mirrorMD, mirrorErr := readCopyMetadata(mirror)
+	switch {
+	case os.IsNotExist(primaryErr) && os.IsNotExist(mirrorErr):
+		// deleted while comparing
+		return nil, "", "", nil
+	case os.IsNotExist(primaryErr):
+		return &MirrorDivergence{Key: key, Reason: "missing from the primary volume"}, mirror, primary, nil
+	case os.IsNotExist(mirrorErr):
+		return &MirrorDivergence{Key: key, Reason: "missing from the mirror volume"}, primary, mirror, nil
+	case primaryErr != nil:
+		return nil, "", "", primaryErr
+	case mirrorErr != nil:
+		return nil, "", "", mirrorErr
+	}
+
+	primaryErr = verifyObject(primary, keys)
+	mirrorErr = verifyObject(mirror, keys)
+	switch {
+	case primaryErr != nil && !isObjectDamaged(primaryErr):
+		return nil, "", "", primaryErr
+	case mirrorErr != nil && !isObjectDamaged(mirrorErr):
+		return nil, "", "", mirrorErr
+	case primaryErr != nil && mirrorErr != nil:
+		return &MirrorDivergence{Key: key, Reason: "both copies are damaged"}, "", "", nil
+	case primaryErr != nil:
+		return &MirrorDivergence{Key: key, Reason: "primary copy is damaged: " + primaryErr.Error()}, mirror, primary, nil
+	case mirrorErr != nil:
+		return &MirrorDivergence{Key: key, Reason: "mirror copy is damaged: " + mirrorErr.Error()}, primary, mirror, nil
+	}
+
+	// Intact copies hold what their checksums say, copies without checksums have to be compared
+	same := primaryMD != nil && mirrorMD != nil && *primaryMD == *mirrorMD
+	if primaryMD == nil || mirrorMD == nil || primaryMD.ChecksumKey != mirrorMD.ChecksumKey {
+		var err error
+		if same, err = sameContents(primary, mirror, keys); err != nil {
+			return nil, "", "", err
+		}
+	}
+	if same {
+		return nil, "", "", nil
+	}
+	// Both copies are intact, the primary is the copy Velero reads
+	return &MirrorDivergence{Key: key, Reason: "copies hold different objects"}, primary, mirror, nil
+}
+
+// readCopyMetadata returns the metadata of the object at path. Unlike readObjectMetadata it fails
+// with a not exist error if the object itself doesn't exist.
+func readCopyMetadata(path string) (*comparableMetadata, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	md, err := readObjectMetadata(path)
+	if err != nil || md == nil {
+		return nil, err
+	}
+	cmd := &comparableMetadata{SHA256: md.SHA256, Size: md.Size}
+	if md.KeyedChecksum {
+		cmd.ChecksumKey = md.EncryptionKeySecret + "/" + md.EncryptionKeyID
+	}
+	return cmd, nil
+}
+
+// comparableMetadata is the part of an object's metadata that identifies its contents.
+type comparableMetadata struct {
+	SHA256 string
+	Size   int64
+	// ChecksumKey is the encryption key a keyed checksum is derived from, checksums under different keys can't be compared.
+	ChecksumKey string
+}
+
+// sameContents returns truthy if the objects at a and b hold the same data once decoded.
+func sameContents(a, b string, keys *Keyring) (bool, error) {
+	sumA, err := decodedChecksum(a, keys)
+	if err != nil {
+		return false, err
+	}
+	sumB, err := decodedChecksum(b, keys)
+	if err != nil {
+		return false, err
+	}
+	return sumA == sumB, nil
+}
+
+// decodedChecksum returns the checksum of the object at path once decoded.
+func decodedChecksum(path string, keys *Keyring) (comparableMetadata, error) {
+	rc, err := readObject(path, keys)
+	if err != nil {
+		return comparableMetadata{}, err
+	}
+	defer rc.Close()
+
+	checksum := newChecksumReader(rc)
+	if _, err := io.Copy(io.Discard, checksum); err != nil {
+		return comparableMetadata{}, err
+	}
+	md := checksum.metadata()
+	return comparableMetadata{SHA256: md.SHA256, Size: md.Size}, nil
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_getMirrorConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		vt         VolumeType
+		config     map[string]string
+		wantType   VolumeType
+		wantConfig map[string]string
+		wantErr    bool
+	}{
+		{
+			name:   "no mirror",
+			vt:     Hostpath,
+			config: map[string]string{"bucket": "snapshots", "path": "/backups"},
+		},
+		{
+			name:       "hostpath mirror",
+			vt:         Hostpath,
+			config:     map[string]string{"bucket": "snapshots", "path": "/backups", "mirrorPath": "/mnt/disk2/backups"},
+			wantType:   Hostpath,
+			wantConfig: map[string]string{"bucket": "snapshots-mirror", "path": "/mnt/disk2/backups", "prefix": ""},
+		},
+		{
+			name: "nfs mirror of a hostpath volume",
+			vt:   Hostpath,
+			config: map[string]string{
+				"bucket":       "snapshots",
+				"prefix":       "velero",
+				"path":         "/backups",
+				"mirrorType":   "nfs",
+				"mirrorBucket": "nfs-snapshots",
+				"mirrorPath":   "/exports/backups",
+				"mirrorServer": "1.2.3.4",
+			},
+			wantType:   NFS,
+			wantConfig: map[string]string{"bucket": "nfs-snapshots", "path": "/exports/backups", "server": "1.2.3.4", "prefix": "velero"},
+		},
+		{
+			name:    "mirror to the same bucket",
+			vt:      Hostpath,
+			config:  map[string]string{"bucket": "snapshots", "mirrorBucket": "snapshots"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown volume type",
+			vt:      Hostpath,
+			config:  map[string]string{"bucket": "snapshots", "mirrorType": "s3"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotType, gotConfig, err := getMirrorConfig(tt.vt, tt.config)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantType, gotType)
+			require.Equal(t, tt.wantConfig, gotConfig)
+		})
+	}
+}
+
+func Test_Mirror(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "mirror"), 0755))
+	o.mirror = "mirror"
+
+	key := "backups/b1/velero-backup.json"
+	primary := filepath.Join(root, "bucket", key)
+	mirror := filepath.Join(root, "mirror", key)
+
+	require.NoError(t, o.PutObject("bucket", key, strings.NewReader(`{"kind":"Backup"}`)))
+	require.FileExists(t, mirror)
+	require.FileExists(t, metadataPath(mirror))
+
+	// A primary copy that is missing or doesn't match the size in its metadata is read from the mirror
+	for _, damage := range []func() error{
+		func() error { return os.WriteFile(primary, []byte(`{"kind":"Back`), 0644) },
+		func() error { return os.Remove(primary) },
+	} {
+		require.NoError(t, damage())
+		rc, err := o.GetObject("bucket", key)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		require.Equal(t, `{"kind":"Backup"}`, string(got))
+	}
+
+	// Other damage is only found once the primary copy is read, and is reported
+	require.NoError(t, os.WriteFile(primary, []byte(`{"kind":"B4ckup"}`), 0644))
+	rc, err := o.GetObject("bucket", key)
+	require.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.NoError(t, rc.Close())
+
+	divergences, err := RepairMirror("bucket", "mirror", "", false, nil, logrus.New())
+	require.NoError(t, err)
+	require.Len(t, divergences, 1)
+	require.False(t, divergences[0].Repaired)
+
+	divergences, err = RepairMirror("bucket", "mirror", "", true, nil, logrus.New())
+	require.NoError(t, err)
+	require.Len(t, divergences, 1)
+	require.True(t, divergences[0].Repaired)
+	require.NoError(t, verifyObject(primary, nil))
+
+	divergences, err = RepairMirror("bucket", "mirror", "", false, nil, logrus.New())
+	require.NoError(t, err)
+	require.Empty(t, divergences)
+
+	require.NoError(t, o.DeleteObject("bucket", key))
+	require.NoFileExists(t, primary)
+	require.NoFileExists(t, mirror)
+}
@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// nfsSuperMagic is the statfs filesystem type of NFS mounts.
+const nfsSuperMagic = 0x6969
+
+// mountInfoPath lists the mounts visible to the plugin.
+const mountInfoPath = "/proc/self/mountinfo"
+
+// VolumeNotMountedError is returned when the volume of a bucket is not mounted where the plugin expects it,
+// e.g. because the Velero pod hasn't been restarted since the volume was added. Anything written to the
+// path would go to the container's own filesystem and be lost when it restarts.
+type VolumeNotMountedError struct {
+	Bucket string
+	Path   string
+	Reason string
+}
+
+func (e *VolumeNotMountedError) Error() string {
+	return fmt.Sprintf("volume for bucket %q is not mounted at %s: %s. The BackupStorageLocation is unavailable until the Velero pod restarts with the volume attached", e.Bucket, e.Path, e.Reason)
+}
+
+// verifyMountpoint returns a *VolumeNotMountedError unless path is the mountpoint of a volume of type vt.
+func verifyMountpoint(bucket, path string, vt VolumeType) error {
+	var stat, parentStat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		if os.IsNotExist(err) {
+			return &VolumeNotMountedError{Bucket: bucket, Path: path, Reason: "the path does not exist"}
+		}
+		return errors.Wrapf(err, "failed to check mountpoint %s", path)
+	}
+	if err := syscall.Stat(filepath.Dir(path), &parentStat); err != nil {
+		return errors.Wrapf(err, "failed to check mountpoint %s", path)
+	}
+
+	// A volume is on a different device than the directory it is mounted in, unless it is
+	// a bind mount from the same filesystem, which only shows up in the mount table
+	if stat.Dev == parentStat.Dev {
+		mounted, err := isListedMountpoint(path)
+		if err != nil {
+			return err
+		}
+		if !mounted {
+			return &VolumeNotMountedError{Bucket: bucket, Path: path, Reason: "the path is on the container's filesystem"}
+		}
+	}
+
+	if vt == NFS {
+		var fsStat syscall.Statfs_t
+		if err := syscall.Statfs(path, &fsStat); err != nil {
+			return errors.Wrapf(err, "failed to check mountpoint %s", path)
+		}
+		if fsStat.Type != nfsSuperMagic {
+			return &VolumeNotMountedError{Bucket: bucket, Path: path, Reason: fmt.Sprintf("the filesystem is not NFS (type %#x)", fsStat.Type)}
+		}
+	}
+	return nil
+}
+
+// isListedMountpoint returns truthy if path is a mountpoint in the mount table.
+func isListedMountpoint(path string) (bool, error) {
+	file, err := os.Open(mountInfoPath)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read mount table")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The mountpoint is the fifth field, with spaces and other special characters escaped in octal
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && unescapeMountInfo(fields[4]) == path {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, errors.Wrap(err, "failed to read mount table")
+	}
+	return false, nil
+}
+
+// unescapeMountInfo replaces the octal escapes in a mountinfo field, e.g. "\040" for a space.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
@@ -0,0 +1,43 @@
+package plugin
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_verifyMountpoint(t *testing.T) {
+	var notMountedErr *VolumeNotMountedError
+
+	err := verifyMountpoint("bucket", filepath.Join(t.TempDir(), "missing"), Hostpath)
+	require.ErrorAs(t, err, &notMountedErr)
+	require.Contains(t, err.Error(), "does not exist")
+
+	err = verifyMountpoint("bucket", t.TempDir(), Hostpath)
+	require.ErrorAs(t, err, &notMountedErr)
+	require.Contains(t, err.Error(), "container's filesystem")
+
+	// The root filesystem is always mounted
+	require.NoError(t, verifyMountpoint("bucket", "/", Hostpath))
+}
+
+func Test_unescapeMountInfo(t *testing.T) {
+	require.Equal(t, "/var/lib/my volume", unescapeMountInfo(`/var/lib/my\040volume`))
+	require.Equal(t, `/var/lib/\volume`, unescapeMountInfo(`/var/lib/\volume`))
+	require.Equal(t, "/var/lib/volume", unescapeMountInfo("/var/lib/volume"))
+}
+
+func Test_PutObject_VolumeNotMounted(t *testing.T) {
+	o, _ := newTestObjectStore(t, "bucket")
+	o.verifyMount = verifyMountpoint
+
+	var notMountedErr *VolumeNotMountedError
+	err := o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("{}"))
+	require.ErrorAs(t, err, &notMountedErr)
+	require.Equal(t, "bucket", notMountedErr.Bucket)
+
+	err = o.DeleteObject("bucket", "backups/b1/velero-backup.json")
+	require.ErrorAs(t, err, &notMountedErr)
+}
@@ -1,9 +1,10 @@
 package plugin
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -23,22 +24,53 @@ type LocalVolumeObjectStore struct {
 	log        logrus.FieldLogger
 	volumeType VolumeType
 	opts       *localVolumeObjectStoreOpts
+	prefix     string
+	encoding   objectEncoding
+	keys       *Keyring
+	retention  time.Duration
+	softDelete time.Duration
+	// maxVersions is the number of previous versions kept of overwritten objects, 0 disables versioning
+	maxVersions int
+	deduplicate bool
+	chunkSize   int64
+	mirror      string
+	mirrorType  VolumeType
+	space       *spaceGuard
+	timeout     operationTimeout
+	// verifyMount checks that a bucket's volume is mounted, it is replaced in tests
+	verifyMount func(bucket, path string, vt VolumeType) error
 }
 
 // NewLocalVolumeObjectStore instantiates a LocalVolumeObjectStore with a particular target volume type.
 func NewLocalVolumeObjectStore(log logrus.FieldLogger, v VolumeType) *LocalVolumeObjectStore {
 	return &LocalVolumeObjectStore{
-		log:        log,
-		volumeType: v,
+		log:         log,
+		volumeType:  v,
+		verifyMount: verifyMountpoint,
 	}
 }
 
 // Init initializes the plugin. It can be called multiple times.
 // It is part of the Velero plugin interface.
 func (o *LocalVolumeObjectStore) Init(config map[string]string) error {
-	bucket := config["bucket"]
-	prefix := config["prefix"]
-	path := filepath.Join(getRoot(), bucket)
+	cfg, unknownKeys, err := parseBSLConfig(o.volumeType, config)
+	if err != nil {
+		return err
+	}
+	bucket, prefix := cfg.volume.bucket, cfg.prefix
+	path, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return err
+	}
+	o.prefix = prefix
+	o.encoding.Compression = cfg.compression
+	o.retention = cfg.retention
+	o.softDelete = cfg.softDelete
+	o.maxVersions = cfg.maxVersions
+	o.deduplicate = cfg.deduplicate
+	o.chunkSize = cfg.chunkSize
+	o.space = &spaceGuard{reserve: cfg.reserve, quota: cfg.quota}
+	o.timeout.timeout = cfg.operationTimeout
 
 	log := o.log.WithFields(logrus.Fields{
 		"bucket": bucket,
@@ -46,27 +78,44 @@ func (o *LocalVolumeObjectStore) Init(config map[string]string) error {
 		"prefix": prefix,
 	})
 	log.Debug("LocalVolumeObjectStore.Init called")
+	for _, key := range unknownKeys {
+		log.Warnf("Ignoring unknown config key %q", key)
+	}
 
 	if err := o.getLocalVolumeStoreOpts(); err != nil {
 		return errors.Wrap(err, "failed to get local volume configuration")
 	}
 
-	if err := ensureFilesystem(path, prefix, log); err != nil {
-		return errors.Wrap(err, "failed to ensure filesystem")
+	o.mirror, o.mirrorType = "", ""
+	if cfg.mirror != nil {
+		o.mirror, o.mirrorType = cfg.mirror.bucket, cfg.mirror.volumeType
+	}
+
+	// The limits are picked up again on every Init, so changes to the config map apply without a restart
+	throttleFor(bucket).configure(o.opts.throttle)
+	if o.mirror != "" {
+		throttleFor(o.mirror).configure(o.opts.throttle)
 	}
+	sharedCache.configure(o.opts.cache)
 
 	clientset, err := k8sutil.GetClientset()
 	if err != nil {
 		return errors.Wrap(err, "failed to get kubernetes clientset")
 	}
 
+	// Keys are needed to read encrypted objects even if new objects are not encrypted
+	o.keys = NewKeyring(clientset, os.Getenv("VELERO_NAMESPACE"))
+	if err := o.initEncryption(cfg); err != nil {
+		return errors.Wrap(err, "failed to configure encryption")
+	}
+
 	ensureResourcesOpts := EnsureResourcesOpts{
 		clientset:  clientset,
 		namespace:  os.Getenv("VELERO_NAMESPACE"),
 		bucket:     bucket,
 		prefix:     prefix,
 		path:       path,
-		config:     config,
+		config:     cfg,
 		pluginOpts: o.opts,
 		volumeType: o.volumeType,
 		log:        log,
@@ -76,57 +125,301 @@ func (o *LocalVolumeObjectStore) Init(config map[string]string) error {
 		return errors.Wrap(err, "failed to ensure resources")
 	}
 
-	return nil
+	// Everything that touches the volume is timed, including the sweeps of the whole bucket
+	return o.timeout.run(bucket, "Init", true, func(w *watchdog) error {
+		// The volumes are only mounted once the pod restarts with them, until then
+		// nothing can be written without it ending up on the container's filesystem
+		if err := o.verifyMounted(bucket); err != nil {
+			return err
+		}
+		// Read-only locations are only restored from, so they are used as they are
+		if cfg.volume.readOnly {
+			return nil
+		}
+
+		if err := ensureFilesystem(path, prefix, log); err != nil {
+			return errors.Wrap(err, "failed to ensure filesystem")
+		}
+		if o.mirror != "" {
+			if err := ensureFilesystem(filepath.Join(getRoot(), o.mirror), prefix, log.WithField("mirror", o.mirror)); err != nil {
+				return errors.Wrap(err, "failed to ensure mirror filesystem")
+			}
+		}
+
+		if err := removeStaleFiles(filepath.Join(path, prefix), log); err != nil {
+			log.WithError(err).Warn("Failed to remove stale files")
+		}
+
+		if o.softDelete > 0 {
+			if err := purgeTrash(path, o.softDelete, log); err != nil {
+				log.WithError(err).Warn("Failed to purge the trash")
+			}
+		}
+
+		// Blobs are left behind by objects purged from the trash or the previous versions, and by crashes
+		if err := removeUnusedBlobs(path, log); err != nil {
+			log.WithError(err).Warn("Failed to remove unused blobs")
+		}
+		return nil
+	})
 }
 
 // PutObject puts an object into the LocalVolumeObjectStore.
 // It is part of the Velero plugin interface.
 func (o *LocalVolumeObjectStore) PutObject(bucket string, key string, body io.Reader) error {
-	path := filepath.Join(getRoot(), bucket, key)
-
 	log := o.log.WithFields(logrus.Fields{
 		"bucket": bucket,
 		"key":    key,
-		"path":   path,
 	})
 	log.Debug("LocalVolumeObjectStore.PutObject called")
 
+	// Reading the upload from Velero doesn't count towards the timeout, only the time spent writing it does.
+	// Resolving the key reads the volume as well, so it is timed too.
+	return o.timeout.run(bucket, "PutObject", false, func(w *watchdog) error {
+		path, err := o.objectPath(bucket, key)
+		if err != nil {
+			return err
+		}
+		release := throttleFor(bucket).uploads.acquire(w)
+		defer release()
+		return o.putObject(bucket, key, path, w.pause(body), w, log.WithField("path", path))
+	})
+}
+
+// putObject writes body to the object at path.
+func (o *LocalVolumeObjectStore) putObject(bucket, key, path string, body io.Reader, w *watchdog, log *logrus.Entry) error {
+	if err := o.verifyMounted(bucket); err != nil {
+		return err
+	}
+	bucketPath, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := o.lockForWrite(bucketPath, key, w)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := o.checkObjectLock(bucket, key, path); err != nil {
+		return err
+	}
+	if o.space.enabled() {
+		if err := o.space.check(bucket, o.prefix, bucketPath); err != nil {
+			log.WithError(err).Warn("Refusing to write object")
+			return err
+		}
+	}
+
 	dir := filepath.Dir(path)
 	log.Debugf("Creating dir %s", dir)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := createDirs(dir); err != nil {
 		return err
 	}
 
-	log.Debug("Creating file")
-	file, err := os.Create(path)
+	log.Debug("Writing to file")
+	checksum, err := newObjectChecksumReader(body, o.encoding, o.keys)
+	if err != nil {
+		return err
+	}
+	data, err := encodeReader(checksum, o.encoding, o.keys)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer data.Close()
+	// Each reader wraps the previous one, so the bandwidth limit applies whatever else is enabled
+	var stored io.Reader = throttleFor(bucket).reader(data, w)
+	blobHash := sha256.New()
+	if o.deduplicate {
+		stored = io.TeeReader(stored, blobHash)
+	}
+	if o.space.enabled() {
+		stored = &guardedReader{reader: stored, guard: o.space, bucket: bucket, prefix: o.prefix, bucketPath: bucketPath}
+	}
+	staged, err := stageChunkedFile(path, stored, o.chunkSize)
+	if err != nil {
+		return err
+	}
+	if o.space.enabled() {
+		if err := o.space.checkQuota(bucket, o.prefix, bucketPath, staged.size); err != nil {
+			staged.Abort()
+			return err
+		}
+		o.space.wrote(bucketPath, staged.size)
+	}
+	if o.maxVersions > 0 {
+		// If the upload fails from here on the version is the same as the object, which is harmless
+		versionPath, err := saveVersion(bucketPath, o.bucketRelative(key), path, o.maxVersions)
+		if err != nil {
+			staged.Abort()
+			return err
+		}
+		if versionPath != "" {
+			log.Debugf("Kept previous object as %s", versionPath)
+		}
+	}
+	// The parts of the previous object are only removed once the new object is in place
+	replaced, err := partsOf(path)
+	if err != nil {
+		staged.Abort()
+		return err
+	}
 
-	log.Debug("Writing to file")
-	_, err = io.Copy(file, body)
+	// The manifest of a replaced chunked object would be read as the contents of a small object without
+	// metadata, so overwriting one is detected by the checksum instead.
+	if o.encoding.encoded() || o.retention > 0 || o.deduplicate || len(staged.parts) > 0 || len(replaced) > 0 {
+		md := checksum.metadata()
+		md.objectEncoding = o.encoding
+		md.Parts = len(staged.parts)
+		if o.encoding.encoded() {
+			md.StoredSize = staged.size
+		}
+		if o.retention > 0 {
+			retainUntil := time.Now().Add(o.retention)
+			md.RetainUntil = &retainUntil
+		}
+		var previous *objectMetadata
+		if o.deduplicate {
+			md.Blob = hex.EncodeToString(blobHash.Sum(nil))
+			if previous, err = readObjectMetadata(path); err != nil {
+				log.WithError(err).Warn("Failed to read metadata of the previous object, its blob will be removed on the next start if unused")
+			}
+			if err := linkBlob(bucketPath, md.Blob, staged); err != nil {
+				staged.Abort()
+				return err
+			}
+		}
+
+		// An encoded or chunked object can't be read and a retained object isn't protected without its metadata,
+		// so the metadata goes in place first. A crash in between leaves the previous object with
+		// metadata it fails verification against.
+		log.Debug("Writing metadata")
+		if err := writeObjectMetadata(path, md); err != nil {
+			staged.Abort()
+			return err
+		}
+		if err := staged.Commit(); err != nil {
+			removeObjectMetadata(path)
+			return err
+		}
+		sharedCache.invalidate(bucketPath, path)
+		if previous != nil && previous.Blob != "" && previous.Blob != md.Blob {
+			if err := removeUnusedBlob(bucketPath, previous.Blob, log); err != nil {
+				log.WithError(err).Warn("Failed to remove unused blob")
+			}
+		}
+		o.removeReplacedParts(replaced, log)
+
+		return o.mirrorObject(key, path, w, log)
+	}
+
+	// Remove the old metadata first so that a crash before the new metadata is written
+	// leaves an unverified object behind rather than one that fails verification.
+	if err := removeObjectMetadata(path); err != nil {
+		staged.Abort()
+		return err
+	}
+	if err := staged.Commit(); err != nil {
+		return err
+	}
+	sharedCache.invalidate(bucketPath, path)
+	o.removeReplacedParts(replaced, log)
+
+	// The object is already in place, so without metadata it's only unverified like objects written
+	// by older versions of the plugin. Failing the upload now would not bring the previous object back.
+	log.Debug("Writing metadata")
+	if err := writeObjectMetadata(path, checksum.metadata()); err != nil {
+		log.WithError(err).Warn("Failed to write object metadata, the object will not be verified when read")
+	}
+
+	return o.mirrorObject(key, path, w, log)
+}
+
+// removeReplacedParts removes the part files of an object that was overwritten. Parts left behind
+// are removed as orphans on the next start.
+func (o *LocalVolumeObjectStore) removeReplacedParts(parts []string, log *logrus.Entry) {
+	if err := removeParts(parts); err != nil {
+		log.WithError(err).Warn("Failed to remove parts of the previous object")
+	}
+}
+
+// mirrorObject copies an object that was just written to the mirror volume, if there is one.
+func (o *LocalVolumeObjectStore) mirrorObject(key, path string, w *watchdog, log *logrus.Entry) error {
+	if o.mirror == "" {
+		log.Debug("Done")
+		return nil
+	}
+
+	mirrorPath, err := o.objectPath(o.mirror, key)
+	if err != nil {
+		return err
+	}
+	mirrorBucketPath, err := resolveBucket(getRoot(), o.mirror)
+	if err != nil {
+		return err
+	}
+	unlock, err := o.lockForWrite(mirrorBucketPath, key, w)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if o.space.enabled() {
+		size, err := objectStoredSize(path)
+		if err != nil {
+			return err
+		}
+		if err := o.space.checkReserve(o.mirror, o.prefix, mirrorBucketPath); err != nil {
+			return errors.Wrapf(err, "failed to mirror object to %s", o.mirror)
+		}
+		if err := o.space.checkQuota(o.mirror, o.prefix, mirrorBucketPath, size); err != nil {
+			return errors.Wrapf(err, "failed to mirror object to %s", o.mirror)
+		}
+		o.space.wrote(mirrorBucketPath, size)
+	}
+
+	log.Debugf("Mirroring to %s", mirrorPath)
+	err = throttledCopyObject(path, mirrorPath, throttleFor(o.mirror), w)
+	sharedCache.invalidate(mirrorBucketPath, mirrorPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to mirror object to %s", o.mirror)
+	}
 
 	log.Debug("Done")
-	return err
+	return nil
 }
 
 // ObjectExists returns truthy if an object is in the LocalVolumeObjectStore.
 // It is part of the Velero plugin interface.
 func (o *LocalVolumeObjectStore) ObjectExists(bucket, key string) (bool, error) {
-	path := filepath.Join(getRoot(), bucket, key)
+	// The plugin's own files are hidden rather than rejected
+	if hasInternalName(o.bucketRelative(key)) {
+		return false, nil
+	}
 
 	log := o.log.WithFields(logrus.Fields{
 		"bucket": bucket,
 		"key":    key,
-		"path":   path,
 	})
 	log.Debug("LocalVolumeObjectStore.ObjectExists called")
 
-	_, err := os.Stat(path)
+	var invalidKey bool
+	err := o.timeout.run(bucket, "ObjectExists", true, func(w *watchdog) error {
+		path, err := o.objectPath(bucket, key)
+		if err != nil {
+			invalidKey = true
+			return err
+		}
+		_, err = os.Stat(path)
+		return err
+	})
 	if err == nil {
 		return true, nil
 	}
+	if invalidKey {
+		return false, err
+	}
 	if os.IsNotExist(err) {
 		return false, nil
 	}
@@ -137,107 +430,271 @@ func (o *LocalVolumeObjectStore) ObjectExists(bucket, key string) (bool, error)
 // GetObject returns truthy if an object is in the LocalVolumeObjectStore.
 // It is part of the Velero plugin interface.
 func (o *LocalVolumeObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
-	path := filepath.Join(getRoot(), bucket, key)
-
 	log := o.log.WithFields(logrus.Fields{
 		"bucket": bucket,
 		"key":    key,
-		"path":   path,
 	})
 	log.Debug("LocalVolumeObjectStore.GetObject called")
 
-	return os.Open(path)
+	// Objects in the cache are served without reading the volume, beyond checking that they haven't changed
+	var path string
+	var rc io.ReadCloser
+	var cached bool
+	err := o.timeout.run(bucket, "GetObject", true, func(w *watchdog) error {
+		var err error
+		if path, err = o.objectPath(bucket, key); err != nil {
+			return err
+		}
+		rc, cached = sharedCache.object(path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log = log.WithField("path", path)
+	if cached {
+		log.Debug("Found object in cache")
+		return rc, nil
+	}
+
+	// The download lasts until Velero closes the object
+	throttle := throttleFor(bucket)
+	release := throttle.downloads.acquire(nil)
+
+	err = o.timeout.run(bucket, "GetObject", true, func(w *watchdog) error {
+		// The version is taken before the object is opened, so that a change while it is read isn't cached
+		version, err := statVersion(path)
+		if err != nil {
+			return err
+		}
+		rc, err = o.getObject(key, path, log)
+		if err != nil {
+			return err
+		}
+		rc, err = sharedCache.fillObject(path, version, rc)
+		return err
+	})
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: throttle.readCloser(o.timeout.reader(bucket, "GetObject", rc)), release: release}, nil
+}
+
+// releasingReadCloser calls release once it is closed.
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
 }
 
-// ListCommonPrefixes returns a list of subdirectories in the root of the LocalVolumeObjectStore.
+func (r *releasingReadCloser) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
+
+// getObject opens the object at path, or its copy on the mirror if the object is missing or its size
+// disagrees with its metadata.
+func (o *LocalVolumeObjectStore) getObject(key, path string, log *logrus.Entry) (io.ReadCloser, error) {
+	if o.mirror == "" {
+		return readObject(path, o.keys)
+	}
+
+	// Reading the whole copy to verify it first would double the reads of every restore, so other damage is
+	// reported as a checksum error while it is streamed. A bad copy can't be swapped for the mirror halfway through.
+	rc, err := readSizedObject(path, o.keys)
+	if err == nil || !isObjectDamaged(err) {
+		return rc, err
+	}
+
+	mirrorPath, mirrorErr := o.objectPath(o.mirror, key)
+	if mirrorErr != nil {
+		return nil, mirrorErr
+	}
+	if _, mirrorErr := os.Stat(mirrorPath); mirrorErr != nil {
+		// Not on the mirror either
+		return nil, err
+	}
+	log.WithError(err).Warnf("Primary copy is missing or damaged, reading from the mirror %s. Run the mirror repair command to fix the primary copy", o.mirror)
+	return readObject(mirrorPath, o.keys)
+}
+
+// ListCommonPrefixes returns the distinct prefixes of keys under prefix, up to and including the first
+// delimiter after prefix, e.g. "backups/b1/" for the prefix "backups/" and the delimiter "/".
 // It is part of the Velero plugin interface.
 func (o *LocalVolumeObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
-	path := filepath.Join(getRoot(), bucket, prefix, delimiter)
-
 	log := o.log.WithFields(logrus.Fields{
 		"bucket":    bucket,
 		"delimiter": delimiter,
-		"path":      path,
 		"prefix":    prefix,
 	})
 	log.Debug("LocalVolumeObjectStore.ListCommonPrefixes called")
 
-	dirEntries, err := os.ReadDir(path)
-	if err != nil {
-		return nil, err
-	}
-
-	var dirs []string
-	for _, dirEntry := range dirEntries {
-		if dirEntry.IsDir() && !sliceContainsString(directoryDenyList, dirEntry.Name()) {
-			dirs = append(dirs, dirEntry.Name())
+	var prefixes []string
+	err := o.timeout.run(bucket, "ListCommonPrefixes", true, func(w *watchdog) error {
+		bucketPath, err := o.prefixPath(bucket, prefix)
+		if err != nil {
+			return err
 		}
-	}
-
-	return dirs, nil
+		key := listingCacheKey(bucketPath, "prefixes\x00"+prefix+"\x00"+delimiter)
+		prefixes, err = sharedCache.listing(key, func(deps fileVersions) ([]string, error) {
+			return listCommonPrefixes(bucketPath, prefix, delimiter, deps)
+		})
+		return err
+	})
+	return prefixes, err
 }
 
-// ListObjects returns a list of files in the LocalVolumeObjectStore.
+// ListObjects returns the keys of all objects under the prefix in the LocalVolumeObjectStore, in sorted order.
 // It is part of the Velero plugin interface.
 func (o *LocalVolumeObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
-	path := filepath.Join(getRoot(), bucket, prefix)
-
 	log := o.log.WithFields(logrus.Fields{
 		"bucket": bucket,
 		"prefix": prefix,
-		"path":   path,
 	})
 	log.Debug("LocalVolumeObjectStore.ListObjects called")
 
-	dirEntries, err := os.ReadDir(path)
-	if err != nil {
-		return nil, err
-	}
-
-	var objects []string
-	for _, dirEntry := range dirEntries {
-		objects = append(objects, filepath.Join(prefix, dirEntry.Name()))
-	}
-
-	return objects, nil
+	var keys []string
+	err := o.timeout.run(bucket, "ListObjects", true, func(w *watchdog) error {
+		bucketPath, err := o.prefixPath(bucket, prefix)
+		if err != nil {
+			return err
+		}
+		keys, err = sharedCache.listing(listingCacheKey(bucketPath, "objects\x00"+prefix), func(deps fileVersions) ([]string, error) {
+			return listObjectKeys(bucketPath, prefix, deps)
+		})
+		return err
+	})
+	return keys, err
 }
 
 // DeleteObject removes a files from the LocalVolumeObjectStore.
 // It is part of the Velero plugin interface.
 func (o *LocalVolumeObjectStore) DeleteObject(bucket, key string) error {
-	path := filepath.Join(getRoot(), bucket, key)
-
 	log := o.log.WithFields(logrus.Fields{
 		"bucket": bucket,
 		"key":    key,
-		"path":   path,
 	})
 	log.Debug("LocalVolumeObjectStore.DeleteObject called")
 
-	err := os.Remove(path)
+	// Deleting again after a transient error is safe
+	return o.timeout.run(bucket, "DeleteObject", true, func(w *watchdog) error {
+		path, err := o.objectPath(bucket, key)
+		if err != nil {
+			return err
+		}
+		return o.deleteObjectCopies(bucket, key, path, w, log.WithField("path", path))
+	})
+}
 
-	// This logic is specific to a file system; we need to clean up the backup directory
-	// if there's nothing left. "Normal" object stores only mimic directory structures and don't need this.
-	keyParts := strings.Split(key, "/")
-	var backupPath string
-	if len(keyParts) > 1 {
-		backupPath = filepath.Join(getRoot(), bucket, keyParts[0], keyParts[1])
+// deleteObjectCopies deletes the object at path and its copy on the mirror.
+func (o *LocalVolumeObjectStore) deleteObjectCopies(bucket, key, path string, w *watchdog, log *logrus.Entry) error {
+	if err := o.verifyMounted(bucket); err != nil {
+		return err
 	}
-	if backupPath != "" {
-		infos, err := ioutil.ReadDir(backupPath)
+	bucketPath, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return err
+	}
+	keyLock, err := lockKey(bucketPath, o.bucketRelative(key), w)
+	if err != nil {
+		return err
+	}
+	defer keyLock.Unlock()
+
+	if err := o.checkObjectLock(bucket, key, path); err != nil {
+		log.WithError(err).Warn("Refusing to delete locked object")
+		return err
+	}
+
+	if err := o.deleteObject(bucket, path, log); err != nil {
+		return err
+	}
+
+	if o.mirror != "" {
+		mirrorPath, err := o.objectPath(o.mirror, key)
+		if err != nil {
+			return err
+		}
+		mirrorBucketPath, err := resolveBucket(getRoot(), o.mirror)
+		if err != nil {
+			return err
+		}
+		mirrorLock, err := lockKey(mirrorBucketPath, o.bucketRelative(key), w)
 		if err != nil {
 			return err
 		}
-		if len(infos) == 0 {
-			l := o.log.WithFields(logrus.Fields{
-				"backupPath": backupPath,
-			})
-			l.Debug("Deleted backup directory")
-			os.Remove(backupPath)
+		defer mirrorLock.Unlock()
+		if err := o.deleteObject(o.mirror, mirrorPath, log.WithField("mirror", o.mirror)); err != nil {
+			return errors.Wrapf(err, "failed to delete object from mirror %s", o.mirror)
 		}
 	}
 
-	return err
+	return nil
+}
+
+// deleteObject removes the object at path from a bucket, or moves it to the trash when soft delete is enabled.
+// An object that is already gone counts as deleted.
+func (o *LocalVolumeObjectStore) deleteObject(bucket, path string, log *logrus.Entry) error {
+	bucketPath, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return err
+	}
+	key, err := filepath.Rel(bucketPath, path)
+	if err != nil {
+		return err
+	}
+	key = filepath.ToSlash(key)
+	md, err := readObjectMetadata(path)
+	if err != nil {
+		log.WithError(err).Warn("Failed to read object metadata, its blob will be removed on the next start if unused")
+	}
+	if o.softDelete > 0 {
+		deletedAt := time.Now()
+		err = moveToTrash(bucketPath, path, deletedAt)
+		if err == nil {
+			// The previous versions go with the object, so they are restored or purged along with it
+			err = moveVersionsToTrash(bucketPath, key, deletedAt)
+		}
+	} else {
+		err = removeObjectFile(path)
+		if o.space.enabled() {
+			o.space.forget(bucketPath)
+		}
+	}
+	sharedCache.invalidate(bucketPath, path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := removeObjectMetadata(path); err != nil {
+		return err
+	}
+	if md != nil && md.Blob != "" {
+		if err := removeUnusedBlob(bucketPath, md.Blob, log); err != nil {
+			log.WithError(err).Warn("Failed to remove unused blob")
+		}
+	}
+	if err := removeVersions(bucketPath, key); err != nil {
+		return err
+	}
+
+	// This logic is specific to a file system; we need to clean up the directories of the object
+	// if there's nothing left. "Normal" object stores only mimic directory structures and don't need this.
+	// Directories are only removed while nothing is being written, the next delete cleans up otherwise.
+	treeLock, locked, err := tryLockTreeExclusive(bucketPath)
+	if err != nil {
+		log.WithError(err).Warn("Failed to lock bucket directories for cleanup")
+		return nil
+	}
+	if !locked {
+		log.Debug("Bucket directories are being written to, skipping cleanup")
+		return nil
+	}
+	defer treeLock.Unlock()
+
+	if err := pruneEmptyDirs(bucketPath, versionsDirName, filepath.Dir(versionsPath(bucketPath, key)), log); err != nil {
+		return err
+	}
+	return pruneEmptyDirs(bucketPath, o.prefix, filepath.Dir(path), log)
 }
 
 // CreateSignedURL creates a signed URL to the pod ID for anonymous external access to LocalVolumeObjectStore files.
@@ -249,6 +706,14 @@ func (o *LocalVolumeObjectStore) CreateSignedURL(bucket, key string, ttl time.Du
 	})
 	log.Debug("LocalVolumeObjectStore.CreateSignedURL called")
 
+	err := o.timeout.run(bucket, "CreateSignedURL", true, func(w *watchdog) error {
+		_, err := o.objectPath(bucket, key)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
 	namespace := os.Getenv("VELERO_NAMESPACE")
 
 	signedUrl := url.URL{
@@ -257,7 +722,7 @@ func (o *LocalVolumeObjectStore) CreateSignedURL(bucket, key string, ttl time.Du
 		Path:   fmt.Sprintf("/%s/%s", bucket, key),
 	}
 
-	err := SignURL(&signedUrl, namespace, ttl)
+	err = SignURL(&signedUrl, namespace, ttl)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to create signed url")
 	}
@@ -265,6 +730,74 @@ func (o *LocalVolumeObjectStore) CreateSignedURL(bucket, key string, ttl time.Du
 	return signedUrl.String(), nil
 }
 
+// lockForWrite locks key in the bucket at bucketPath for writing, and the directories of the bucket
+// so that the directory being written to isn't removed.
+func (o *LocalVolumeObjectStore) lockForWrite(bucketPath, key string, w *watchdog) (func(), error) {
+	keyLock, err := lockKey(bucketPath, o.bucketRelative(key), w)
+	if err != nil {
+		return nil, err
+	}
+	treeLock, err := lockTree(bucketPath, w)
+	if err != nil {
+		keyLock.Unlock()
+		return nil, err
+	}
+	return func() {
+		treeLock.Unlock()
+		keyLock.Unlock()
+	}, nil
+}
+
+// verifyMounted returns a *VolumeNotMountedError unless the volumes of bucket and its mirror are mounted.
+func (o *LocalVolumeObjectStore) verifyMounted(bucket string) error {
+	path, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return err
+	}
+	if err := o.verifyMount(bucket, path, o.volumeType); err != nil {
+		return err
+	}
+	if o.mirror == "" {
+		return nil
+	}
+	mirrorPath, err := resolveBucket(getRoot(), o.mirror)
+	if err != nil {
+		return err
+	}
+	return o.verifyMount(o.mirror, mirrorPath, o.mirrorType)
+}
+
+// checkObjectLock returns an *ObjectLockedError if the object at path can't be deleted or overwritten yet.
+func (o *LocalVolumeObjectStore) checkObjectLock(bucket, key, path string) error {
+	bucketPath, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return err
+	}
+	return checkObjectLock(bucketPath, key, path, o.retention)
+}
+
+// initEncryption sets up encryption of new objects with the key from the BSL config or the plugin config map, if there is one.
+func (o *LocalVolumeObjectStore) initEncryption(config *bslConfig) error {
+	secretName := config.encryptionKeySecret
+	if secretName == "" {
+		secretName = o.opts.encryptionKeySecret
+	}
+	if secretName == "" {
+		if config.encryptionKeyID != "" {
+			return errors.New("encryptionKeyId is set but there is no encryptionKeySecret")
+		}
+		o.encoding.EncryptionKeySecret, o.encoding.EncryptionKeyID = "", ""
+		return nil
+	}
+
+	keyID, err := o.keys.activeKeyID(secretName, config.encryptionKeyID)
+	if err != nil {
+		return err
+	}
+	o.encoding.EncryptionKeySecret, o.encoding.EncryptionKeyID = secretName, keyID
+	return nil
+}
+
 // getLocalVolumeStoreOpts looks for the optional plugin config map and then uses it
 // to populate options for the rest of the plugin calls.
 func (o *LocalVolumeObjectStore) getLocalVolumeStoreOpts() error {
@@ -286,12 +819,24 @@ func (o *LocalVolumeObjectStore) getLocalVolumeStoreOpts() error {
 			}
 		}
 
+		throttle, err := parseThrottleOpts(pluginConfigMap.Data)
+		if err != nil {
+			return err
+		}
+		cache, err := parseCacheOpts(pluginConfigMap.Data)
+		if err != nil {
+			return err
+		}
+
 		o.opts = &localVolumeObjectStoreOpts{
 			fileserverImage:           pluginConfigMap.Data["fileserverImage"],
 			securityContextRunAsUser:  pluginConfigMap.Data["securityContextRunAsUser"],
 			securityContextRunAsGroup: pluginConfigMap.Data["securityContextRunAsGroup"],
 			securityContextFSGroup:    pluginConfigMap.Data["securityContextFsGroup"],
 			preserveVolumes:           preserveVolumes,
+			encryptionKeySecret:       pluginConfigMap.Data["encryptionKeySecret"],
+			throttle:                  throttle,
+			cache:                     cache,
 		}
 	}
 	return nil
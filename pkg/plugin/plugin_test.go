@@ -0,0 +1,392 @@
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestObjectStore returns an object store rooted in a temporary directory with a single bucket.
+func newTestObjectStore(t *testing.T, bucket string) (*LocalVolumeObjectStore, string) {
+	root := t.TempDir()
+	t.Setenv("VOLUME_ROOT", root)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, bucket), 0755))
+
+	o := NewLocalVolumeObjectStore(logrus.New(), Hostpath)
+	// The temporary directory is not a volume mount
+	o.verifyMount = func(bucket, path string, vt VolumeType) error { return nil }
+	return o, root
+}
+
+func Test_PutObject_GetObject(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		body    string
+		corrupt func(t *testing.T, path string)
+		wantErr error
+	}{
+		{
+			name: "object is read back unchanged",
+			key:  "backups/b1/velero-backup.json",
+			body: `{"kind":"Backup"}`,
+		},
+		{
+			name: "corrupted object fails verification",
+			key:  "backups/b1/b1.tar.gz",
+			body: "backup contents",
+			corrupt: func(t *testing.T, path string) {
+				require.NoError(t, os.WriteFile(path, []byte("backup c0ntents"), 0644))
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+		{
+			name: "truncated object fails verification",
+			key:  "backups/b1/b1-logs.gz",
+			body: "backup logs",
+			corrupt: func(t *testing.T, path string) {
+				require.NoError(t, os.Truncate(path, 3))
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+		{
+			name: "object without metadata is still readable",
+			key:  "backups/b1/b1-resource-list.json.gz",
+			body: "resources",
+			corrupt: func(t *testing.T, path string) {
+				require.NoError(t, os.Remove(metadataPath(path)))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, root := newTestObjectStore(t, "bucket")
+
+			err := o.PutObject("bucket", tt.key, strings.NewReader(tt.body))
+			require.NoError(t, err)
+
+			if tt.corrupt != nil {
+				tt.corrupt(t, filepath.Join(root, "bucket", tt.key))
+			}
+
+			rc, err := o.GetObject("bucket", tt.key)
+			require.NoError(t, err)
+			defer rc.Close()
+
+			got, err := io.ReadAll(rc)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.body, string(got))
+		})
+	}
+}
+
+func Test_Compression(t *testing.T) {
+	body := strings.Repeat(`{"kind":"Backup","metadata":{"name":"b1"}}`, 100)
+
+	tests := []struct {
+		name     string
+		writeAs  string
+		readAs   string
+		wantSize int // 0 means the object is stored compressed
+	}{
+		{
+			name:    "compressed object",
+			writeAs: "zstd",
+			readAs:  "zstd",
+		},
+		{
+			name:    "compressed object after compression is disabled",
+			writeAs: "zstd",
+			readAs:  "none",
+		},
+		{
+			name:     "uncompressed object after compression is enabled",
+			writeAs:  "",
+			readAs:   "zstd",
+			wantSize: len(body),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, root := newTestObjectStore(t, "bucket")
+			path := filepath.Join(root, "bucket", "backups/b1/b1-logs")
+
+			var err error
+			o.encoding.Compression, err = parseCompression(tt.writeAs)
+			require.NoError(t, err)
+			require.NoError(t, o.PutObject("bucket", "backups/b1/b1-logs", strings.NewReader(body)))
+
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			if tt.wantSize != 0 {
+				require.Equal(t, int64(tt.wantSize), info.Size())
+			} else {
+				require.Less(t, info.Size(), int64(len(body)))
+			}
+
+			o.encoding.Compression, err = parseCompression(tt.readAs)
+			require.NoError(t, err)
+			rc, err := o.GetObject("bucket", "backups/b1/b1-logs")
+			require.NoError(t, err)
+			defer rc.Close()
+
+			got, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.Equal(t, body, string(got))
+		})
+	}
+
+	_, err := parseCompression("gzip")
+	require.Error(t, err)
+}
+
+func Test_MetadataIsHidden(t *testing.T) {
+	o, _ := newTestObjectStore(t, "bucket")
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("{}")))
+
+	objects, err := o.ListObjects("bucket", "backups/b1/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/b1/velero-backup.json"}, objects)
+
+	exists, err := o.ObjectExists("bucket", "backups/b1/"+metadataFilePrefix+"velero-backup.json")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/velero-backup.json"))
+	_, err = os.Stat(metadataPath(filepath.Join(getRoot(), "bucket", "backups/b1/velero-backup.json")))
+	require.True(t, os.IsNotExist(err), "metadata should be removed with the object")
+}
+
+func Test_DeleteObject_RemovesOrphanedMetadata(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("{}")))
+	path := filepath.Join(root, "bucket", "backups/b1/velero-backup.json")
+	require.NoError(t, os.Remove(path))
+
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/velero-backup.json"), "an object that is already gone is deleted")
+	_, err := os.Stat(metadataPath(path))
+	require.True(t, os.IsNotExist(err), "metadata should be removed even if the object is already gone")
+}
+
+func Test_DeleteObject_PrunesEmptyDirectories(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	key := "restic/default/data/ab/abcdef"
+
+	require.NoError(t, o.PutObject("bucket", key, strings.NewReader("pack")))
+	require.NoError(t, o.DeleteObject("bucket", key))
+	require.NoDirExists(t, filepath.Join(root, "bucket", "restic/default"))
+	require.DirExists(t, filepath.Join(root, "bucket", "restic"))
+
+	// Deleting it again is not an error
+	require.NoError(t, o.DeleteObject("bucket", key))
+}
+
+func Test_ListObjects(t *testing.T) {
+	files := []string{
+		"backups/b1/velero-backup.json",
+		"backups/b1/b1.tar.gz",
+		"backups/b10/velero-backup.json",
+		"backups/nightly-1/velero-backup.json",
+		"backups/nightly-2/velero-backup.json",
+		"restic/default/config",
+		"restic/default/data/00/0011",
+		"restic/default/data/ab/ab12",
+		"lost+found/orphan",
+		"backups/b1/" + tempFilePrefix + "b1-logs.gz.123",
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		want   []string
+	}{
+		{
+			name:   "directory prefix",
+			prefix: "backups/b1/",
+			want:   []string{"backups/b1/b1.tar.gz", "backups/b1/velero-backup.json"},
+		},
+		{
+			name:   "nested directories are walked and only files are returned",
+			prefix: "restic/",
+			want:   []string{"restic/default/config", "restic/default/data/00/0011", "restic/default/data/ab/ab12"},
+		},
+		{
+			name:   "partial name prefix",
+			prefix: "backups/nightly-",
+			want:   []string{"backups/nightly-1/velero-backup.json", "backups/nightly-2/velero-backup.json"},
+		},
+		{
+			name:   "denylisted entries are skipped",
+			prefix: "",
+			want: []string{
+				"backups/b1/b1.tar.gz",
+				"backups/b1/velero-backup.json",
+				"backups/b10/velero-backup.json",
+				"backups/nightly-1/velero-backup.json",
+				"backups/nightly-2/velero-backup.json",
+				"restic/default/config",
+				"restic/default/data/00/0011",
+				"restic/default/data/ab/ab12",
+			},
+		},
+		{
+			name:   "missing prefix has no objects",
+			prefix: "restores/r1/",
+			want:   []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, root := newTestObjectStore(t, "bucket")
+			for _, file := range files {
+				path := filepath.Join(root, "bucket", file)
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+				require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+			}
+
+			got, err := o.ListObjects("bucket", tt.prefix)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_ListObjects_DenyList(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	files := []string{
+		"backups/found/velero-backup.json",
+		"backups/lost/velero-backup.json",
+		"backups/b1/t/x",
+		"backups/b1/lost+found/x",
+		"lost+found/orphan",
+	}
+	for _, file := range files {
+		path := filepath.Join(root, "bucket", file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+	}
+
+	// Only the lost+found at the root of the bucket is skipped, names that are part of it are not
+	got, err := o.ListObjects("bucket", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/b1/lost+found/x", "backups/b1/t/x", "backups/found/velero-backup.json", "backups/lost/velero-backup.json"}, got)
+}
+
+func Test_ListCommonPrefixes(t *testing.T) {
+	files := []string{
+		"backups/b1/velero-backup.json",
+		"backups/nightly-1/velero-backup.json",
+		"backups/nightly-2/velero-backup.json",
+		"backups/weekly-1/velero-backup.json",
+		"velero/backups/b2/velero-backup.json",
+		"restores/",
+		"lost+found/",
+		"plugins/x-1_y-1_z",
+		"backups/deleted/",
+		"backups/hidden-only/" + metadataFilePrefix + "velero-backup.json",
+	}
+
+	tests := []struct {
+		name      string
+		prefix    string
+		delimiter string
+		want      []string
+	}{
+		{
+			name:      "root of the bucket",
+			prefix:    "",
+			delimiter: "/",
+			want:      []string{"backups/", "plugins/", "velero/"},
+		},
+		{
+			name:      "directories without objects are not prefixes",
+			prefix:    "backups/",
+			delimiter: "/",
+			want:      []string{"backups/b1/", "backups/nightly-1/", "backups/nightly-2/", "backups/weekly-1/"},
+		},
+		{
+			name:      "partial name prefix",
+			prefix:    "backups/nightly-",
+			delimiter: "/",
+			want:      []string{"backups/nightly-1/", "backups/nightly-2/"},
+		},
+		{
+			name:      "bucket prefix",
+			prefix:    "velero/backups/",
+			delimiter: "/",
+			want:      []string{"velero/backups/b2/"},
+		},
+		{
+			name:      "delimiter other than the path separator",
+			prefix:    "backups/",
+			delimiter: "-",
+			want:      []string{"backups/b1/velero-", "backups/nightly-", "backups/weekly-"},
+		},
+		{
+			name:      "delimiter inside a file name",
+			prefix:    "plugins/",
+			delimiter: "_",
+			want:      []string{"plugins/x-1_"},
+		},
+		{
+			name:      "missing prefix",
+			prefix:    "metadata/",
+			delimiter: "/",
+			want:      []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, root := newTestObjectStore(t, "bucket")
+			for _, file := range files {
+				path := filepath.Join(root, "bucket", file)
+				if strings.HasSuffix(file, "/") {
+					require.NoError(t, os.MkdirAll(path, 0755))
+					continue
+				}
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+				require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+			}
+
+			got, err := o.ListCommonPrefixes("bucket", tt.prefix, tt.delimiter)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_ListCommonPrefixes_DenyList(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	files := []string{
+		"backups/found/velero-backup.json",
+		"backups/lost/velero-backup.json",
+		"backups/t/velero-backup.json",
+		"backups/b1/lost+found/x",
+		"lost+found/orphan",
+	}
+	for _, file := range files {
+		path := filepath.Join(root, "bucket", file)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+	}
+
+	got, err := o.ListCommonPrefixes("bucket", "", "/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/"}, got)
+
+	// Backups named like part of a deny-listed directory are still synced
+	got, err = o.ListCommonPrefixes("bucket", "backups/", "/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/b1/", "backups/found/", "backups/lost/", "backups/t/"}, got)
+}
@@ -0,0 +1,323 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// spaceCheckInterval is how much of an object is written between checks of the free space and quota,
+// so that a large upload stops before it fills the volume rather than once it has.
+const spaceCheckInterval = 64 * 1024 * 1024
+
+// usageCacheTTL is how long the usage of a bucket is trusted before the bucket is walked again.
+// Objects written through the plugin are counted as they are written.
+const usageCacheTTL = time.Minute
+
+// InsufficientSpaceError is returned when an object can't be written without the volume going below its
+// free space reserve, or the bucket going over its quota.
+type InsufficientSpaceError struct {
+	Bucket string
+	Prefix string
+	// Quota is set if the bucket is over its quota rather than the volume being below its reserve.
+	Quota bool
+	// Limit is the free space reserve or the quota, in bytes.
+	Limit int64
+	// Shortfall is how far past the limit the write would go, in bytes.
+	Shortfall int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	location := fmt.Sprintf("bucket %q", e.Bucket)
+	if e.Prefix != "" {
+		location += fmt.Sprintf(" with prefix %q", e.Prefix)
+	}
+	if e.Quota {
+		return fmt.Sprintf("%s is full: writing would exceed its quota of %s by %s", location, formatBytes(e.Limit), formatBytes(e.Shortfall))
+	}
+	return fmt.Sprintf("%s is full: writing would leave %s less free space on the volume than the %s reserve", location, formatBytes(e.Shortfall), formatBytes(e.Limit))
+}
+
+// formatBytes returns a size in bytes in binary units, e.g. "1.5Gi".
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%ci", value, units[unit])
+}
+
+// spaceReserve is the free space that must be left on a volume, either in bytes or as a percentage of its size.
+type spaceReserve struct {
+	bytes   int64
+	percent int64
+}
+
+// parseSpaceReserve validates the value of the "freeSpaceReserve" BSL config key,
+// which is either a quantity such as "1Gi" or a percentage of the volume such as "5%".
+func parseSpaceReserve(s string) (spaceReserve, error) {
+	if s == "" {
+		return spaceReserve{}, nil
+	}
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseInt(strings.TrimSuffix(s, "%"), 10, 64)
+		if err != nil || percent < 0 || percent >= 100 {
+			return spaceReserve{}, errors.Errorf("freeSpaceReserve must be a quantity or a percentage below 100%%, got %q", s)
+		}
+		return spaceReserve{percent: percent}, nil
+	}
+	bytes, err := parseBytes("freeSpaceReserve", s)
+	return spaceReserve{bytes: bytes}, err
+}
+
+// parseBytes parses a Kubernetes quantity, such as "50Gi", into a number of bytes.
+func parseBytes(name, s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	quantity, err := resource.ParseQuantity(s)
+	if err != nil || quantity.Sign() < 0 {
+		return 0, errors.Errorf("%s must be a quantity such as 10Gi, got %q", name, s)
+	}
+	return quantity.Value(), nil
+}
+
+// volumeSpace returns the space available to the plugin on the volume at path and the size of the volume, in bytes.
+func volumeSpace(path string) (available, total int64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, errors.Wrap(err, "failed to get free space")
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Blocks) * int64(stat.Bsize), nil
+}
+
+// spaceGuard refuses writes to a bucket that would take the volume below its free space reserve
+// or the bucket over its quota.
+type spaceGuard struct {
+	reserve spaceReserve
+	quota   int64
+
+	mu      sync.Mutex
+	usage   map[string]int64
+	usageAt map[string]time.Time
+}
+
+// enabled returns truthy if there is anything to check.
+func (g *spaceGuard) enabled() bool {
+	return g != nil && (g.reserve != spaceReserve{} || g.quota > 0)
+}
+
+// check returns an *InsufficientSpaceError if the volume holding the bucket at bucketPath is already
+// below its reserve, or the bucket is at its quota.
+func (g *spaceGuard) check(bucket, prefix, bucketPath string) error {
+	if err := g.checkReserve(bucket, prefix, bucketPath); err != nil {
+		return err
+	}
+	return g.checkQuota(bucket, prefix, bucketPath, 0)
+}
+
+// checkReserve returns an *InsufficientSpaceError if the volume holding the bucket at bucketPath has less
+// free space than its reserve.
+func (g *spaceGuard) checkReserve(bucket, prefix, bucketPath string) error {
+	if g.reserve == (spaceReserve{}) {
+		return nil
+	}
+	available, total, err := volumeSpace(bucketPath)
+	if err != nil {
+		return err
+	}
+	reserve := g.reserve.bytes
+	if g.reserve.percent > 0 {
+		reserve = total * g.reserve.percent / 100
+	}
+	if available <= reserve {
+		return &InsufficientSpaceError{Bucket: bucket, Prefix: prefix, Limit: reserve, Shortfall: reserve - available}
+	}
+	return nil
+}
+
+// checkQuota returns an *InsufficientSpaceError if the bucket at bucketPath would be over its quota
+// with pending more bytes written to it.
+func (g *spaceGuard) checkQuota(bucket, prefix, bucketPath string, pending int64) error {
+	if g.quota == 0 {
+		return nil
+	}
+	usage, err := g.bucketUsage(bucketPath)
+	if err != nil {
+		return err
+	}
+	// A bucket that is already at its quota has no room for any object
+	if pending == 0 {
+		pending = 1
+	}
+	if usage+pending > g.quota {
+		return &InsufficientSpaceError{Bucket: bucket, Prefix: prefix, Quota: true, Limit: g.quota, Shortfall: usage + pending - g.quota}
+	}
+	return nil
+}
+
+// bucketUsage returns the bytes used on the volume by the bucket at bucketPath.
+func (g *spaceGuard) bucketUsage(bucketPath string) (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.usage == nil {
+		g.usage = make(map[string]int64)
+		g.usageAt = make(map[string]time.Time)
+	}
+	if usageAt, ok := g.usageAt[bucketPath]; ok && time.Since(usageAt) < usageCacheTTL {
+		return g.usage[bucketPath], nil
+	}
+
+	usage, err := measureUsage(bucketPath)
+	if err != nil {
+		return 0, err
+	}
+
+	g.usage[bucketPath] = usage.PhysicalBytes
+	g.usageAt[bucketPath] = time.Now()
+	return usage.PhysicalBytes, nil
+}
+
+// wrote counts bytes written to the bucket at bucketPath until its usage is next calculated.
+func (g *spaceGuard) wrote(bucketPath string, n int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.usageAt[bucketPath]; ok {
+		g.usage[bucketPath] += n
+	}
+}
+
+// forget drops the usage of the bucket at bucketPath so it is calculated again, e.g. after a delete.
+func (g *spaceGuard) forget(bucketPath string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.usageAt, bucketPath)
+}
+
+// guardedReader checks the space guard every spaceCheckInterval bytes read through it,
+// and fails the read once the write would run out of space.
+type guardedReader struct {
+	reader     io.Reader
+	guard      *spaceGuard
+	bucket     string
+	prefix     string
+	bucketPath string
+	read       int64
+	checked    int64
+}
+
+func (r *guardedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.read-r.checked >= spaceCheckInterval {
+		r.checked = r.read
+		// The free space already reflects what has been written, the usage of the bucket doesn't
+		if checkErr := r.guard.checkReserve(r.bucket, r.prefix, r.bucketPath); checkErr != nil {
+			return n, checkErr
+		}
+		if checkErr := r.guard.checkQuota(r.bucket, r.prefix, r.bucketPath, r.read); checkErr != nil {
+			return n, checkErr
+		}
+	}
+	return n, err
+}
+
+// Usage is the space used by a bucket.
+type Usage struct {
+	Objects int
+	// LogicalBytes adds up the stored size of every object, as if none of them were deduplicated.
+	LogicalBytes int64
+	// PhysicalBytes is the space used on the volume by everything in the bucket, including the trash,
+	// previous versions and the plugin's own files. Files linked more than once are counted once.
+	PhysicalBytes int64
+}
+
+// measureUsage walks the bucket at bucketPath to find its usage.
+func measureUsage(bucketPath string) (Usage, error) {
+	type inode struct{ dev, ino uint64 }
+	var usage Usage
+	seen := make(map[inode]bool)
+	err := filepath.WalkDir(bucketPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Objects being written are counted by the write itself
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), tempFilePrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		// The parts of a chunked object count towards its size
+		if !isInternalPath(bucketPath, filepath.Dir(p)) {
+			if !isInternalName(d.Name()) {
+				usage.Objects++
+				usage.LogicalBytes += info.Size()
+			} else if strings.HasPrefix(d.Name(), partFilePrefix) {
+				usage.LogicalBytes += info.Size()
+			}
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+			id := inode{dev: uint64(stat.Dev), ino: stat.Ino}
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		usage.PhysicalBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return Usage{}, errors.Wrap(err, "failed to calculate bucket usage")
+	}
+	return usage, nil
+}
+
+// isInternalPath returns truthy if path in the bucket at bucketPath belongs to the plugin rather than to an object.
+func isInternalPath(bucketPath, path string) bool {
+	rel, err := filepath.Rel(bucketPath, path)
+	if err != nil {
+		return true
+	}
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if isInternalName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// BucketUsage returns the space used by a bucket under the volume root.
+func BucketUsage(bucket string) (Usage, error) {
+	bucketPath, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return Usage{}, err
+	}
+	return measureUsage(bucketPath)
+}
@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSpaceReserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    spaceReserve
+		wantErr bool
+	}{
+		{name: "unset", value: "", want: spaceReserve{}},
+		{name: "quantity", value: "1Gi", want: spaceReserve{bytes: 1024 * 1024 * 1024}},
+		{name: "percentage", value: "5%", want: spaceReserve{percent: 5}},
+		{name: "whole volume", value: "100%", wantErr: true},
+		{name: "negative", value: "-1Gi", wantErr: true},
+		{name: "invalid", value: "lots", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseSpaceReserve(test.value)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func Test_FreeSpaceReserve(t *testing.T) {
+	o, _ := newTestObjectStore(t, "bucket")
+	o.space = &spaceGuard{reserve: spaceReserve{bytes: 1 << 62}}
+
+	var spaceErr *InsufficientSpaceError
+	err := o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("{}"))
+	require.ErrorAs(t, err, &spaceErr)
+	require.False(t, spaceErr.Quota)
+	require.Contains(t, err.Error(), `bucket "bucket"`)
+
+	exists, err := o.ObjectExists("bucket", "backups/b1/velero-backup.json")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	o.space = &spaceGuard{reserve: spaceReserve{percent: 1}}
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("{}")))
+}
+
+func Test_Quota(t *testing.T) {
+	o, _ := newTestObjectStore(t, "bucket")
+	o.space = &spaceGuard{quota: 1024}
+	data := strings.Repeat("x", 600)
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/b1.tar.gz", strings.NewReader(data)))
+
+	var spaceErr *InsufficientSpaceError
+	err := o.PutObject("bucket", "backups/b2/b2.tar.gz", strings.NewReader(data))
+	require.ErrorAs(t, err, &spaceErr)
+	require.True(t, spaceErr.Quota)
+	require.Equal(t, int64(1200-1024), spaceErr.Shortfall)
+
+	objects, err := o.ListObjects("bucket", "backups/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/b1/b1.tar.gz"}, objects, "the refused object is not left behind")
+
+	// Deleting frees up the quota straight away
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/b1.tar.gz"))
+	require.NoError(t, o.PutObject("bucket", "backups/b2/b2.tar.gz", strings.NewReader(data)))
+}
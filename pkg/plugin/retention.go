@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// legalHoldFileName marks a directory whose objects can't be deleted or overwritten until the hold is cleared.
+const legalHoldFileName = internalFilePrefix + "legal-hold"
+
+// ObjectLockedError is returned when an object can't be deleted or overwritten because of
+// the retention period of the BackupStorageLocation or a legal hold.
+type ObjectLockedError struct {
+	Key string
+	// RetainUntil is set when the object is still in its retention period.
+	RetainUntil time.Time
+	// LegalHold is the prefix of the legal hold on the object, if there is one.
+	LegalHold string
+}
+
+func (e *ObjectLockedError) Error() string {
+	if e.LegalHold != "" {
+		return fmt.Sprintf("object %q is under a legal hold on %q and can't be deleted or overwritten until the hold is cleared", e.Key, e.LegalHold)
+	}
+	return fmt.Sprintf("object %q is under retention until %s and can't be deleted or overwritten before then", e.Key, e.RetainUntil.UTC().Format(time.RFC3339))
+}
+
+// legalHold is the contents of a legal hold marker.
+type legalHold struct {
+	Reason string    `json:"reason,omitempty"`
+	SetAt  time.Time `json:"setAt"`
+}
+
+// parseRetentionDays validates the value of the "retentionDays" BSL config key.
+func parseRetentionDays(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	days, err := strconv.Atoi(s)
+	if err != nil || days < 0 {
+		return 0, errors.Errorf("retentionDays must be a positive number of days, got %q", s)
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// checkObjectLock returns an *ObjectLockedError if the object at path in the bucket at bucketPath
+// must not be deleted or overwritten. Objects written without a retention period are kept for
+// retention since they were last modified, so enabling retention also protects existing objects.
+func checkObjectLock(bucketPath, key, path string, retention time.Duration) error {
+	if hold, found, err := findLegalHold(bucketPath, filepath.Dir(path)); err != nil {
+		return err
+	} else if found {
+		return &ObjectLockedError{Key: key, LegalHold: hold}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	md, err := readObjectMetadata(path)
+	if err != nil {
+		return err
+	}
+
+	var retainUntil time.Time
+	if md != nil && md.RetainUntil != nil {
+		retainUntil = *md.RetainUntil
+	} else if retention > 0 {
+		retainUntil = info.ModTime().Add(retention)
+	}
+	if time.Now().Before(retainUntil) {
+		return &ObjectLockedError{Key: key, RetainUntil: retainUntil}
+	}
+	return nil
+}
+
+// findLegalHold looks for a legal hold on dir or any of its parents up to the bucket and returns
+// the prefix it was placed on. A hold on the whole bucket has the prefix "/".
+func findLegalHold(bucketPath, dir string) (string, bool, error) {
+	for {
+		_, err := os.Stat(filepath.Join(dir, legalHoldFileName))
+		if err == nil {
+			rel, err := filepath.Rel(bucketPath, dir)
+			if err != nil {
+				return "", false, err
+			}
+			if rel == "." {
+				return "/", true, nil
+			}
+			return filepath.ToSlash(rel) + "/", true, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", false, errors.Wrap(err, "failed to check for legal hold")
+		}
+
+		if dir == bucketPath || !strings.HasPrefix(dir, bucketPath) {
+			return "", false, nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// legalHoldPath returns the path of the legal hold marker for a prefix in a bucket under the volume root.
+func legalHoldPath(bucket, prefix string) (string, error) {
+	dir, err := resolveKey(getRoot(), bucket, strings.TrimLeft(prefix, "/"), true)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, legalHoldFileName), nil
+}
+
+// SetLegalHold places a legal hold on every object under prefix in a bucket under the volume root,
+// e.g. "backups/b1/". Objects under a legal hold can't be deleted or overwritten until the hold is cleared.
+func SetLegalHold(bucket, prefix, reason string) error {
+	path, err := legalHoldPath(bucket, prefix)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
+		return errors.Wrapf(err, "prefix %s not found", prefix)
+	}
+
+	data, err := json.Marshal(legalHold{Reason: reason, SetAt: time.Now().UTC()})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal legal hold")
+	}
+	return writeFileAtomic(path, strings.NewReader(string(data)))
+}
+
+// ClearLegalHold removes the legal hold on prefix in a bucket under the volume root.
+func ClearLegalHold(bucket, prefix string) error {
+	path, err := legalHoldPath(bucket, prefix)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("there is no legal hold on %s", prefix)
+		}
+		return errors.Wrap(err, "failed to remove legal hold")
+	}
+	return nil
+}
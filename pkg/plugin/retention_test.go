@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Retention(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	o.retention = 30 * 24 * time.Hour
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("{}")))
+
+	var lockedErr *ObjectLockedError
+	err := o.DeleteObject("bucket", "backups/b1/velero-backup.json")
+	require.ErrorAs(t, err, &lockedErr)
+	require.WithinDuration(t, time.Now().Add(o.retention), lockedErr.RetainUntil, time.Minute)
+
+	err = o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader(`{"overwritten":true}`))
+	require.ErrorAs(t, err, &lockedErr)
+
+	// The lock is kept with the object, so disabling retention doesn't release it
+	o.retention = 0
+	err = o.DeleteObject("bucket", "backups/b1/velero-backup.json")
+	require.ErrorAs(t, err, &lockedErr)
+
+	// Objects written before retention was enabled are kept since they were last modified
+	path := filepath.Join(root, "bucket", "backups/b2/velero-backup.json")
+	require.NoError(t, o.PutObject("bucket", "backups/b2/velero-backup.json", strings.NewReader("{}")))
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	require.NoError(t, os.Chtimes(path, old, old))
+
+	o.retention = 7 * 24 * time.Hour
+	require.NoError(t, o.DeleteObject("bucket", "backups/b2/velero-backup.json"))
+}
+
+func Test_LegalHold(t *testing.T) {
+	o, _ := newTestObjectStore(t, "bucket")
+
+	require.NoError(t, o.PutObject("bucket", "backups/b1/velero-backup.json", strings.NewReader("{}")))
+	require.NoError(t, SetLegalHold("bucket", "backups/b1/", "case 1234"))
+
+	var lockedErr *ObjectLockedError
+	err := o.DeleteObject("bucket", "backups/b1/velero-backup.json")
+	require.ErrorAs(t, err, &lockedErr)
+	require.Equal(t, "backups/b1/", lockedErr.LegalHold)
+
+	objects, err := o.ListObjects("bucket", "backups/b1/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/b1/velero-backup.json"}, objects, "the legal hold marker is hidden")
+
+	require.NoError(t, ClearLegalHold("bucket", "backups/b1/"))
+	require.NoError(t, o.DeleteObject("bucket", "backups/b1/velero-backup.json"))
+
+	require.Error(t, ClearLegalHold("bucket", "backups/b1/"))
+}
@@ -0,0 +1,180 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// minBandwidthBurst is the most that is read at once while the bandwidth is limited, unless the limit is larger.
+const minBandwidthBurst = 64 * 1024
+
+// throttleOpts are the limits on the operations on each bucket, from the plugin config map.
+type throttleOpts struct {
+	// maxUploads and maxDownloads limit the PutObject and GetObject calls that run at once, 0 is unlimited.
+	maxUploads   int
+	maxDownloads int
+	// bandwidth limits the bytes per second read from and written to the volume, 0 is unlimited.
+	bandwidth int64
+}
+
+// parseThrottleOpts validates the limits in the plugin config map.
+func parseThrottleOpts(data map[string]string) (throttleOpts, error) {
+	var opts throttleOpts
+	var err error
+	if opts.maxUploads, err = parseConcurrency("maxConcurrentUploads", data["maxConcurrentUploads"]); err != nil {
+		return throttleOpts{}, err
+	}
+	if opts.maxDownloads, err = parseConcurrency("maxConcurrentDownloads", data["maxConcurrentDownloads"]); err != nil {
+		return throttleOpts{}, err
+	}
+	if opts.bandwidth, err = parseBytes("bandwidthLimit", data["bandwidthLimit"]); err != nil {
+		return throttleOpts{}, err
+	}
+	return opts, nil
+}
+
+func parseConcurrency(name, s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("%s must be a positive number of operations, got %q", name, s)
+	}
+	return n, nil
+}
+
+// bucketThrottle limits the operations on a bucket.
+type bucketThrottle struct {
+	uploads   *concurrencyLimit
+	downloads *concurrencyLimit
+	bandwidth *rate.Limiter
+}
+
+// throttles holds the limits of each bucket, created when the bucket is first used and updated by Init.
+var throttles = struct {
+	mu      sync.Mutex
+	buckets map[string]*bucketThrottle
+}{buckets: make(map[string]*bucketThrottle)}
+
+// throttleFor returns the limits of bucket, which are unlimited until they are configured.
+func throttleFor(bucket string) *bucketThrottle {
+	throttles.mu.Lock()
+	defer throttles.mu.Unlock()
+	t, ok := throttles.buckets[bucket]
+	if !ok {
+		t = &bucketThrottle{
+			uploads:   newConcurrencyLimit(),
+			downloads: newConcurrencyLimit(),
+			bandwidth: rate.NewLimiter(rate.Inf, minBandwidthBurst),
+		}
+		throttles.buckets[bucket] = t
+	}
+	return t
+}
+
+// configure applies the limits in opts. Operations already running keep going, but no new ones start
+// while more than the new limit are running.
+func (t *bucketThrottle) configure(opts throttleOpts) {
+	t.uploads.setLimit(opts.maxUploads)
+	t.downloads.setLimit(opts.maxDownloads)
+	if opts.bandwidth == 0 {
+		t.bandwidth.SetLimit(rate.Inf)
+		return
+	}
+	burst := minBandwidthBurst
+	if opts.bandwidth > minBandwidthBurst {
+		burst = int(opts.bandwidth)
+	}
+	t.bandwidth.SetBurst(burst)
+	t.bandwidth.SetLimit(rate.Limit(opts.bandwidth))
+}
+
+// reader returns a reader of r limited to the bandwidth of the bucket. Time spent waiting for bandwidth
+// doesn't count towards the timeout of the operation w belongs to.
+func (t *bucketThrottle) reader(r io.Reader, w *watchdog) io.Reader {
+	return &throttledReader{r: r, limiter: t.bandwidth, w: w}
+}
+
+// readCloser is like reader for a reader that is closed, for objects returned to Velero.
+func (t *bucketThrottle) readCloser(rc io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{t.reader(rc, nil), rc}
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *rate.Limiter
+	w       *watchdog
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.limiter.Limit() == rate.Inf {
+		return t.r.Read(p)
+	}
+	if burst := t.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		var waitErr error
+		t.w.whilePaused(func() {
+			waitErr = t.limiter.WaitN(context.Background(), n)
+		})
+		if waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// concurrencyLimit limits how many operations run at once. Its limit can be changed while operations run.
+type concurrencyLimit struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newConcurrencyLimit() *concurrencyLimit {
+	l := &concurrencyLimit{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *concurrencyLimit) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.cond.Broadcast()
+}
+
+// acquire waits until the operation can run, and returns a function to call once it is done.
+// Time spent waiting doesn't count towards the timeout of the operation w belongs to.
+func (l *concurrencyLimit) acquire(w *watchdog) func() {
+	w.whilePaused(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for l.limit > 0 && l.active >= l.limit {
+			l.cond.Wait()
+		}
+		l.active++
+	})
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.active--
+			l.cond.Signal()
+		})
+	}
+}
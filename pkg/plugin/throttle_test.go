@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseThrottleOpts(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    throttleOpts
+		wantErr bool
+	}{
+		{name: "unset", data: map[string]string{}, want: throttleOpts{}},
+		{
+			name: "all set",
+			data: map[string]string{"maxConcurrentUploads": "4", "maxConcurrentDownloads": "8", "bandwidthLimit": "50Mi"},
+			want: throttleOpts{maxUploads: 4, maxDownloads: 8, bandwidth: 50 * 1024 * 1024},
+		},
+		{name: "negative uploads", data: map[string]string{"maxConcurrentUploads": "-1"}, wantErr: true},
+		{name: "invalid downloads", data: map[string]string{"maxConcurrentDownloads": "many"}, wantErr: true},
+		{name: "invalid bandwidth", data: map[string]string{"bandwidthLimit": "fast"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseThrottleOpts(test.data)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func Test_concurrencyLimit(t *testing.T) {
+	l := newConcurrencyLimit()
+	l.setLimit(1)
+	release := l.acquire(nil)
+
+	acquired := make(chan func())
+	go func() {
+		acquired <- l.acquire(nil)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired past the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	release()
+	select {
+	case release = <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("not acquired once released")
+	}
+
+	go func() {
+		acquired <- l.acquire(nil)
+	}()
+	l.setLimit(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("not acquired once the limit was raised")
+	}
+}
+
+func Test_throttledReader(t *testing.T) {
+	throttle := throttleFor(t.Name())
+	throttle.configure(throttleOpts{bandwidth: 100 * 1024})
+
+	data := bytes.Repeat([]byte("x"), 150*1024)
+	start := time.Now()
+	got, err := io.ReadAll(throttle.reader(bytes.NewReader(data), nil))
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	// The first 100KiB are the burst, the rest take half a second
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func Test_GetObject_ConcurrencyLimit(t *testing.T) {
+	o, _ := newTestObjectStore(t, t.Name())
+	throttleFor(t.Name()).configure(throttleOpts{maxDownloads: 1})
+	require.NoError(t, o.PutObject(t.Name(), "key", strings.NewReader("data")))
+
+	rc, err := o.GetObject(t.Name(), "key")
+	require.NoError(t, err)
+
+	opened := make(chan io.ReadCloser)
+	go func() {
+		rc, err := o.GetObject(t.Name(), "key")
+		require.NoError(t, err)
+		opened <- rc
+	}()
+	select {
+	case <-opened:
+		t.Fatal("opened past the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, rc.Close())
+	select {
+	case rc = <-opened:
+		require.NoError(t, rc.Close())
+	case <-time.After(time.Second):
+		t.Fatal("not opened once the first download was closed")
+	}
+}
+
+func Test_PutObject_BandwidthLimit(t *testing.T) {
+	o, _ := newTestObjectStore(t, t.Name())
+	throttleFor(t.Name()).configure(throttleOpts{bandwidth: 100 * 1024})
+	o.space = &spaceGuard{quota: 1024 * 1024 * 1024}
+
+	start := time.Now()
+	require.NoError(t, o.PutObject(t.Name(), "key", bytes.NewReader(bytes.Repeat([]byte("x"), 150*1024))))
+	// The quota doesn't bypass the limit, the first 100KiB are the burst and the rest take half a second
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
@@ -0,0 +1,254 @@
+package plugin
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// trashDirName is the directory at the root of a bucket that deleted objects are moved to when soft delete is enabled.
+// Each deletion goes in a directory named after the time of the deletion, under the object's key.
+const trashDirName = internalFilePrefix + "trash"
+
+const trashTimeLayout = "20060102T150405Z"
+
+// TrashedObject is an object in the trash of a bucket.
+type TrashedObject struct {
+	Key       string
+	DeletedAt time.Time
+}
+
+// parseSoftDeleteDays validates the value of the "softDeleteDays" BSL config key.
+func parseSoftDeleteDays(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	days, err := strconv.Atoi(s)
+	if err != nil || days < 0 {
+		return 0, errors.Errorf("softDeleteDays must be a positive number of days, got %q", s)
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// moveToTrash moves the object at path in the bucket at bucketPath, along with its metadata, into the trash.
+func moveToTrash(bucketPath, path string, deletedAt time.Time) error {
+	key, err := filepath.Rel(bucketPath, path)
+	if err != nil {
+		return err
+	}
+	trashPath := filepath.Join(bucketPath, trashDirName, deletedAt.UTC().Format(trashTimeLayout), key)
+
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+	if err := createDirs(filepath.Dir(trashPath)); err != nil {
+		return errors.Wrap(err, "failed to create trash directory")
+	}
+
+	if err := moveObject(path, trashPath); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(trashPath)); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// moveVersionsToTrash moves the previous versions of key in the bucket at bucketPath into the trash,
+// next to the object deleted at deletedAt.
+func moveVersionsToTrash(bucketPath, key string, deletedAt time.Time) error {
+	dir := versionsPath(bucketPath, key)
+	if _, err := os.Lstat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	trashDir := versionsPath(filepath.Join(bucketPath, trashDirName, deletedAt.UTC().Format(trashTimeLayout)), key)
+	if err := createDirs(filepath.Dir(trashDir)); err != nil {
+		return errors.Wrap(err, "failed to create trash directory")
+	}
+	if err := os.Rename(dir, trashDir); err != nil {
+		return errors.Wrap(err, "failed to move previous versions to the trash")
+	}
+	return syncDir(filepath.Dir(trashDir))
+}
+
+// purgeTrash permanently removes everything that was deleted from the bucket at bucketPath longer than age ago.
+func purgeTrash(bucketPath string, age time.Duration, log *logrus.Entry) error {
+	trashPath := filepath.Join(bucketPath, trashDirName)
+	entries, err := os.ReadDir(trashPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	cutoff := time.Now().Add(-age)
+	for _, entry := range entries {
+		deletedAt, err := time.Parse(trashTimeLayout, entry.Name())
+		if err != nil || !entry.IsDir() || deletedAt.After(cutoff) {
+			continue
+		}
+
+		log.Infof("Purging objects deleted at %s from the trash", deletedAt)
+		if err := os.RemoveAll(filepath.Join(trashPath, entry.Name())); err != nil {
+			return errors.Wrapf(err, "failed to purge %s", entry.Name())
+		}
+	}
+	return nil
+}
+
+// listTrash returns every object in the trash of the bucket at bucketPath, most recently deleted first.
+func listTrash(bucketPath string) ([]TrashedObject, error) {
+	trashPath := filepath.Join(bucketPath, trashDirName)
+	entries, err := os.ReadDir(trashPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []TrashedObject{}, nil
+		}
+		return nil, err
+	}
+
+	objects := []TrashedObject{}
+	for _, entry := range entries {
+		deletedAt, err := time.Parse(trashTimeLayout, entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		keys, err := listObjectKeys(filepath.Join(trashPath, entry.Name()), "", nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			objects = append(objects, TrashedObject{Key: key, DeletedAt: deletedAt})
+		}
+	}
+
+	sort.SliceStable(objects, func(i, j int) bool {
+		if !objects[i].DeletedAt.Equal(objects[j].DeletedAt) {
+			return objects[i].DeletedAt.After(objects[j].DeletedAt)
+		}
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// ListTrash returns every object in the trash of a bucket under the volume root, most recently deleted first.
+func ListTrash(bucket string) ([]TrashedObject, error) {
+	bucketPath, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return nil, err
+	}
+	return listTrash(bucketPath)
+}
+
+// RestoreFromTrash moves the most recently deleted copy of every object under prefix in a bucket under
+// the volume root back into place, e.g. "backups/b1/" to restore a backup. Objects that have been
+// written again since they were deleted are left alone. It returns the keys of the restored objects.
+func RestoreFromTrash(bucket, prefix string) ([]string, error) {
+	bucketPath, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := listTrash(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = strings.TrimLeft(prefix, "/")
+	restored := []string{}
+	seen := make(map[string]bool)
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Key, prefix) || seen[object.Key] {
+			continue
+		}
+		seen[object.Key] = true
+
+		path, err := resolveKey(getRoot(), bucket, object.Key, false)
+		if err != nil {
+			return restored, err
+		}
+		restoredKey, err := restoreObject(bucketPath, path, object)
+		if err != nil {
+			return restored, err
+		}
+		if restoredKey {
+			restored = append(restored, object.Key)
+		}
+	}
+
+	if len(restored) > 0 {
+		removeEmptyTrashDirs(filepath.Join(bucketPath, trashDirName))
+	}
+	return restored, nil
+}
+
+// restoreObject moves a trashed object and its previous versions back to path, unless an object has been
+// written there since, and returns truthy if it was restored.
+func restoreObject(bucketPath, path string, object TrashedObject) (bool, error) {
+	keyLock, err := lockKey(bucketPath, object.Key, nil)
+	if err != nil {
+		return false, err
+	}
+	defer keyLock.Unlock()
+	treeLock, err := lockTree(bucketPath, nil)
+	if err != nil {
+		return false, err
+	}
+	defer treeLock.Unlock()
+
+	if _, err := os.Lstat(path); err == nil {
+		return false, nil
+	}
+
+	deletion := filepath.Join(bucketPath, trashDirName, object.DeletedAt.UTC().Format(trashTimeLayout))
+	trashPath := filepath.Join(deletion, filepath.FromSlash(object.Key))
+	if err := createDirs(filepath.Dir(path)); err != nil {
+		return false, err
+	}
+	if err := moveObject(trashPath, path); err != nil {
+		return false, errors.Wrapf(err, "failed to restore %s", object.Key)
+	}
+
+	// Versions the key has again are those of a later object, and are left as they are
+	trashVersions := versionsPath(deletion, object.Key)
+	dir := versionsPath(bucketPath, object.Key)
+	if _, err := os.Lstat(trashVersions); err != nil {
+		return true, nil
+	}
+	if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+		return true, nil
+	}
+	if err := createDirs(filepath.Dir(dir)); err != nil {
+		return true, err
+	}
+	if err := os.Rename(trashVersions, dir); err != nil {
+		return true, errors.Wrapf(err, "failed to restore previous versions of %s", object.Key)
+	}
+	return true, nil
+}
+
+// removeEmptyTrashDirs removes directories in the trash that no longer hold anything.
+func removeEmptyTrashDirs(trashPath string) {
+	var dirs []string
+	filepath.WalkDir(trashPath, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && p != trashPath {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	// Deepest first, so parents are empty by the time they are reached
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
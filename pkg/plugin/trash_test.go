@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SoftDelete(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	o.softDelete = 7 * 24 * time.Hour
+
+	keys := []string{"backups/b1/velero-backup.json", "backups/b1/b1.tar.gz"}
+	for _, key := range keys {
+		require.NoError(t, o.PutObject("bucket", key, strings.NewReader(key)))
+		require.NoError(t, o.DeleteObject("bucket", key))
+	}
+
+	objects, err := o.ListObjects("bucket", "")
+	require.NoError(t, err)
+	require.Empty(t, objects, "the trash is hidden")
+	prefixes, err := o.ListCommonPrefixes("bucket", "", "/")
+	require.NoError(t, err)
+	require.Empty(t, prefixes, "the trash is hidden")
+
+	trashed, err := ListTrash("bucket")
+	require.NoError(t, err)
+	require.Len(t, trashed, 2)
+
+	restored, err := RestoreFromTrash("bucket", "backups/b1/")
+	require.NoError(t, err)
+	require.ElementsMatch(t, keys, restored)
+
+	for _, key := range keys {
+		rc, err := o.GetObject("bucket", key)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err, "metadata is restored with the object")
+		require.NoError(t, rc.Close())
+		require.Equal(t, key, string(got))
+	}
+
+	trashed, err = ListTrash("bucket")
+	require.NoError(t, err)
+	require.Empty(t, trashed)
+	entries, err := os.ReadDir(filepath.Join(root, "bucket", trashDirName))
+	require.NoError(t, err)
+	require.Empty(t, entries, "empty trash directories are removed")
+}
+
+func Test_purgeTrash(t *testing.T) {
+	root := t.TempDir()
+	recent := time.Now().Add(-time.Hour)
+	old := time.Now().Add(-8 * 24 * time.Hour)
+
+	for _, deletedAt := range []time.Time{recent, old} {
+		path := filepath.Join(root, "backups", "b1", "velero-backup.json")
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte("{}"), 0644))
+		require.NoError(t, moveToTrash(root, path, deletedAt))
+	}
+
+	require.NoError(t, purgeTrash(root, 7*24*time.Hour, logrus.NewEntry(logrus.New())))
+
+	trashed, err := listTrash(root)
+	require.NoError(t, err)
+	require.Len(t, trashed, 1)
+	require.WithinDuration(t, recent, trashed[0].DeletedAt, time.Second)
+}
+
+func Test_SoftDelete_Versions(t *testing.T) {
+	o, _ := newTestObjectStore(t, "bucket")
+	o.softDelete = 7 * 24 * time.Hour
+	o.maxVersions = 5
+	key := "backups/b1/velero-backup.json"
+
+	for _, content := range []string{"v1", "v2", "v3"} {
+		require.NoError(t, o.PutObject("bucket", key, strings.NewReader(content)))
+	}
+	require.NoError(t, o.DeleteObject("bucket", key))
+	versions, err := ListVersions("bucket", key)
+	require.NoError(t, err)
+	require.Empty(t, versions, "versions go to the trash with the object")
+	trashed, err := ListTrash("bucket")
+	require.NoError(t, err)
+	require.Len(t, trashed, 1, "versions in the trash are hidden")
+
+	restored, err := RestoreFromTrash("bucket", key)
+	require.NoError(t, err)
+	require.Equal(t, []string{key}, restored)
+	versions, err = ListVersions("bucket", key)
+	require.NoError(t, err)
+	require.Len(t, versions, 2, "versions are restored with the object")
+
+	require.NoError(t, RestoreVersion("bucket", key, 1))
+	rc, err := o.GetObject("bucket", key)
+	require.NoError(t, err)
+	got, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, "v1", string(got))
+}
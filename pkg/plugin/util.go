@@ -4,7 +4,6 @@ import (
 	"io/fs"
 	"os"
 	"strconv"
-	"strings"
 	"syscall"
 
 	"github.com/pkg/errors"
@@ -37,7 +36,7 @@ func getSubDirectoryLayout() []string {
 
 func sliceContainsString(list []string, s string) bool {
 	for _, v := range list {
-		if strings.Contains(v, s) {
+		if v == s {
 			return true
 		}
 	}
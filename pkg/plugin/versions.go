@@ -0,0 +1,211 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// versionsDirName is the directory at the root of a bucket that holds the previous versions of objects
+// when versioning is enabled. The versions of an object are in a directory named after its key,
+// each named by its version number.
+const versionsDirName = internalFilePrefix + "versions"
+
+// ObjectVersion is a previous version of an object.
+type ObjectVersion struct {
+	Version int
+	// Size is the size of the object once decoded, if it is known.
+	Size         int64
+	LastModified time.Time
+}
+
+// parseMaxVersions validates the value of the "maxVersions" BSL config key.
+func parseMaxVersions(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	max, err := strconv.Atoi(s)
+	if err != nil || max < 0 {
+		return 0, errors.Errorf("maxVersions must be a positive number of versions, got %q", s)
+	}
+	return max, nil
+}
+
+// versionsPath returns the directory that holds the versions of key in the bucket at bucketPath.
+func versionsPath(bucketPath, key string) string {
+	return filepath.Join(bucketPath, versionsDirName, filepath.FromSlash(key))
+}
+
+// listVersions returns the versions of key in the bucket at bucketPath, newest first.
+func listVersions(bucketPath, key string) ([]ObjectVersion, error) {
+	dir := versionsPath(bucketPath, key)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []ObjectVersion{}, nil
+		}
+		return nil, err
+	}
+
+	versions := []ObjectVersion{}
+	for _, entry := range entries {
+		version, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		size := info.Size()
+		if md, err := readObjectMetadata(filepath.Join(dir, entry.Name())); err != nil {
+			return nil, err
+		} else if md != nil {
+			size = md.Size
+		}
+		versions = append(versions, ObjectVersion{Version: version, Size: size, LastModified: info.ModTime()})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+	return versions, nil
+}
+
+// saveVersion keeps the object at path as the newest version of key, along with its metadata, and removes
+// the oldest versions beyond maxVersions unless it is 0. It returns the path of the version, or nothing
+// if there is no object at path.
+func saveVersion(bucketPath, key, path string, maxVersions int) (string, error) {
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	versions, err := listVersions(bucketPath, key)
+	if err != nil {
+		return "", err
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[0].Version + 1
+	}
+
+	dir := versionsPath(bucketPath, key)
+	if err := createDirs(dir); err != nil {
+		return "", err
+	}
+	versionPath := filepath.Join(dir, strconv.Itoa(next))
+
+	// The object is about to be replaced by a rename, so a hard link keeps the old contents without copying them.
+	// The parts of a chunked object are removed once it is replaced, so it has to be copied.
+	parts, err := partsOf(path)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) > 0 {
+		err = copyObject(path, versionPath)
+	} else {
+		err = os.Link(metadataPath(path), metadataPath(versionPath))
+		if err == nil || os.IsNotExist(err) {
+			err = os.Link(path, versionPath)
+		}
+		if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EOPNOTSUPP) {
+			err = copyObject(path, versionPath)
+		}
+	}
+	if err != nil {
+		removeVersion(versionPath)
+		return "", errors.Wrap(err, "failed to save previous version")
+	}
+	if err := syncDir(dir); err != nil {
+		return "", err
+	}
+
+	if maxVersions > 0 {
+		for i := maxVersions - 1; i < len(versions); i++ {
+			if err := removeVersion(filepath.Join(dir, strconv.Itoa(versions[i].Version))); err != nil {
+				return versionPath, err
+			}
+		}
+	}
+	return versionPath, nil
+}
+
+// removeVersion removes a version of an object along with its metadata.
+func removeVersion(versionPath string) error {
+	if err := removeObjectFile(versionPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return removeObjectMetadata(versionPath)
+}
+
+// removeVersions removes every version of key in the bucket at bucketPath.
+func removeVersions(bucketPath, key string) error {
+	if err := os.RemoveAll(versionsPath(bucketPath, key)); err != nil {
+		return errors.Wrap(err, "failed to remove previous versions")
+	}
+	return nil
+}
+
+// ListVersions returns the previous versions of key in a bucket under the volume root, newest first.
+func ListVersions(bucket, key string) ([]ObjectVersion, error) {
+	bucketPath, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := resolveKey(getRoot(), bucket, key, false); err != nil {
+		return nil, err
+	}
+	return listVersions(bucketPath, key)
+}
+
+// RestoreVersion replaces key in a bucket under the volume root with one of its previous versions.
+// The object it replaces is kept as the newest version, so restoring can be undone.
+func RestoreVersion(bucket, key string, version int) error {
+	bucketPath, err := resolveBucket(getRoot(), bucket)
+	if err != nil {
+		return err
+	}
+	path, err := resolveKey(getRoot(), bucket, key, false)
+	if err != nil {
+		return err
+	}
+	versionPath := filepath.Join(versionsPath(bucketPath, key), strconv.Itoa(version))
+	if _, err := os.Stat(versionPath); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("%s has no version %d", key, version)
+		}
+		return err
+	}
+
+	keyLock, err := lockKey(bucketPath, key, nil)
+	if err != nil {
+		return err
+	}
+	defer keyLock.Unlock()
+	treeLock, err := lockTree(bucketPath, nil)
+	if err != nil {
+		return err
+	}
+	defer treeLock.Unlock()
+
+	// The retention period of the location isn't known here, but retention recorded with the object still applies
+	if err := checkObjectLock(bucketPath, key, path, 0); err != nil {
+		return err
+	}
+	if _, err := saveVersion(bucketPath, key, path, 0); err != nil {
+		return err
+	}
+	return copyObject(versionPath, path)
+}
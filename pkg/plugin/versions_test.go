@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Versions(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+	o.maxVersions = 2
+	key := "backups/b1/velero-backup.json"
+
+	readObject := func() string {
+		rc, err := o.GetObject("bucket", key)
+		require.NoError(t, err)
+		defer rc.Close()
+		got, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		return string(got)
+	}
+
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		require.NoError(t, o.PutObject("bucket", key, strings.NewReader(content)))
+	}
+	require.Equal(t, "v4", readObject(), "the latest version is read")
+
+	versions, err := ListVersions("bucket", key)
+	require.NoError(t, err)
+	require.Len(t, versions, 2, "only maxVersions are kept")
+	require.Equal(t, 3, versions[0].Version)
+	require.Equal(t, 2, versions[1].Version)
+	require.Equal(t, int64(2), versions[0].Size)
+
+	objects, err := o.ListObjects("bucket", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{key}, objects, "versions are hidden")
+	prefixes, err := o.ListCommonPrefixes("bucket", "", "/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"backups/"}, prefixes, "versions are hidden")
+
+	require.NoError(t, RestoreVersion("bucket", key, 2))
+	require.Equal(t, "v2", readObject())
+	versions, err = ListVersions("bucket", key)
+	require.NoError(t, err)
+	require.Len(t, versions, 3, "the replaced object is kept as a version")
+	require.NoError(t, RestoreVersion("bucket", key, versions[0].Version))
+	require.Equal(t, "v4", readObject(), "restoring can be undone")
+
+	require.Error(t, RestoreVersion("bucket", key, 1), "pruned versions can't be restored")
+
+	require.NoError(t, o.DeleteObject("bucket", key))
+	versions, err = ListVersions("bucket", key)
+	require.NoError(t, err)
+	require.Empty(t, versions, "versions are removed with the object")
+	entries, err := os.ReadDir(filepath.Join(root, "bucket", versionsDirName))
+	require.NoError(t, err)
+	require.Empty(t, entries, "empty version directories are removed")
+}
+
+func Test_Versions_Disabled(t *testing.T) {
+	o, root := newTestObjectStore(t, "bucket")
+
+	require.NoError(t, o.PutObject("bucket", "key", strings.NewReader("v1")))
+	require.NoError(t, o.PutObject("bucket", "key", strings.NewReader("v2")))
+
+	_, err := os.Stat(filepath.Join(root, "bucket", versionsDirName))
+	require.True(t, os.IsNotExist(err))
+}
+
+func Test_parseMaxVersions(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "5", want: 5},
+		{in: "-1", wantErr: true},
+		{in: "five", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := parseMaxVersions(test.in)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
@@ -2,54 +2,101 @@ package plugin
 
 import (
 	"context"
-	"os"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"slices"
+	"strings"
 
 	"github.com/pkg/errors"
-	"github.com/replicatedhq/local-volume-provider/pkg/k8sutil"
 	"github.com/sirupsen/logrus"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	kuberneteserrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
 )
 
 const VolumeProviderKey = "app"
 const VolumeProviderLabel = "velero"
 
+// ManagedByKey and ManagedByLabel mark the persistent volumes and claims the plugin provisions statically.
+const ManagedByKey = "app.kubernetes.io/managed-by"
+const ManagedByLabel = "local-volume-provider"
+
 type VolumeType string
 
 const (
 	Hostpath VolumeType = "hostpath"
 	NFS      VolumeType = "nfs"
 	PVC      VolumeType = "pvc"
+	CSI      VolumeType = "csi"
 )
 
-// buildVoume creates a new k8s volume object based on the Velero BSL Config
-func buildVolume(vt VolumeType, config map[string]string, log *logrus.Entry) (*corev1.Volume, error) {
+// staticVolumeAccessModes returns the access modes of a volume the plugin provisions statically,
+// which is mounted by every node-agent pod as well as Velero.
+func staticVolumeAccessModes(config volumeConfig) []corev1.PersistentVolumeAccessMode {
+	if config.readOnly {
+		return []corev1.PersistentVolumeAccessMode{corev1.ReadOnlyMany}
+	}
+	return []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany}
+}
+
+// buildVoume creates a new k8s volume object based on the Velero BSL Config. nodeAgent is set if the
+// node-agent pods mount the volume as well as Velero.
+func buildVolume(clientset kubernetes.Interface, namespace string, config volumeConfig, nodeAgent bool, log *logrus.Entry) (*corev1.Volume, error) {
 	var volumeSource *corev1.VolumeSource
 
-	var err error
-	switch vt {
+	switch config.volumeType {
 	case Hostpath:
-		volumeSource, err = getHostPathVolumeSource(config)
+		volumeSource = getHostPathVolumeSource(config)
 	case NFS:
-		volumeSource, err = getNFSVolumeSource(config)
+		if !config.persistentVolume {
+			volumeSource = getNFSVolumeSource(config)
+			break
+		}
+		source := corev1.PersistentVolumeSource{NFS: getNFSVolumeSource(config).NFS}
+		claimName, err := ensureStaticVolume(clientset, namespace, config, source, log)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create static volume for %s", config.bucket)
+		}
+		volumeSource = getStaticVolumeSource(config, claimName)
 	case PVC:
-		err = ensurePVC(config, log)
+		if config.existingClaim != "" {
+			if err := verifyExistingClaim(clientset, namespace, config, nodeAgent); err != nil {
+				return nil, errors.Wrapf(err, "failed to verify claim for %s", config.bucket)
+			}
+			volumeSource = &corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: config.existingClaim,
+				},
+			}
+			break
+		}
+		claimName, err := ensurePVC(clientset, namespace, config, log)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create pvc for %s", config.bucket)
+		}
+		volumeSource = getPVCVolumeSource(claimName)
+	case CSI:
+		// Only a persistent volume has a handle, a volume without one is an inline ephemeral volume of the driver
+		if config.volumeHandle == "" {
+			volumeSource = getCSIVolumeSource(config)
+			break
+		}
+		claimName, err := ensureStaticVolume(clientset, namespace, config, getCSIPersistentVolumeSource(namespace, config), log)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to create pvc for %s", config["bucket"])
+			return nil, errors.Wrapf(err, "failed to create static volume for %s", config.bucket)
 		}
-		volumeSource, err = getPVCVolumeSource(config)
+		volumeSource = getStaticVolumeSource(config, claimName)
 	default:
 		return nil, errors.New("unrecognized volume type")
 	}
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to build volume for %s", vt)
-	}
 
 	volume := &corev1.Volume{
-		Name:         config["bucket"],
+		Name:         volumeName(config.volumeType, config.bucket),
 		VolumeSource: *volumeSource,
 	}
 
@@ -57,61 +104,103 @@ func buildVolume(vt VolumeType, config map[string]string, log *logrus.Entry) (*c
 }
 
 // getHostPathVolumeSource returns a hostpath volume source to be used in a k8s volume
-func getHostPathVolumeSource(config map[string]string) (*corev1.VolumeSource, error) {
-	if _, ok := config["path"]; !ok {
-		return nil, errors.New("hostpath config missing path")
-	}
-
-	volumeSource := &corev1.VolumeSource{
+func getHostPathVolumeSource(config volumeConfig) *corev1.VolumeSource {
+	return &corev1.VolumeSource{
 		HostPath: &corev1.HostPathVolumeSource{
-			Path: config["path"],
+			Path: config.path,
 			Type: hostPathTypePtr(corev1.HostPathDirectory),
 		},
 	}
-
-	return volumeSource, nil
 }
 
 // getNFSVolumeSource returns an nfs volume source to be used in a k8s volume
-func getNFSVolumeSource(config map[string]string) (*corev1.VolumeSource, error) {
-	path, ok := config["path"]
-	if !ok {
-		return nil, errors.New("nfs config missing path")
+func getNFSVolumeSource(config volumeConfig) *corev1.VolumeSource {
+	return &corev1.VolumeSource{
+		NFS: &corev1.NFSVolumeSource{
+			Path:     config.path,
+			Server:   config.server,
+			ReadOnly: config.readOnly,
+		},
 	}
+}
 
-	server, ok := config["server"]
-	if !ok {
-		return nil, errors.New("nfs config missing server address")
+// getPVCVolumeSource returns a pvc volume source to be used in a k8s volume
+func getPVCVolumeSource(claimName string) *corev1.VolumeSource {
+	return &corev1.VolumeSource{
+		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+			ClaimName: claimName,
+		},
 	}
+}
 
-	volumeSource := &corev1.VolumeSource{
-		NFS: &corev1.NFSVolumeSource{
-			Path:   path,
-			Server: server,
+// getStaticVolumeSource returns a pvc volume source for the claim of a persistent volume provisioned statically
+func getStaticVolumeSource(config volumeConfig, claimName string) *corev1.VolumeSource {
+	return &corev1.VolumeSource{
+		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+			ClaimName: claimName,
+			ReadOnly:  config.readOnly,
 		},
 	}
-
-	return volumeSource, nil
 }
 
-// getPVCVolumeSource returns an nfs volume source to be used in a k8s volume
-func getPVCVolumeSource(config map[string]string) (*corev1.VolumeSource, error) {
-	pvcName, ok := config["bucket"]
-	if !ok {
-		return nil, errors.New("pvc config missing pvc name")
-	}
+// getCSIVolumeSource returns an inline csi volume source to be used in a k8s volume
+func getCSIVolumeSource(config volumeConfig) *corev1.VolumeSource {
 	volumeSource := &corev1.VolumeSource{
-		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-			ClaimName: pvcName,
+		CSI: &corev1.CSIVolumeSource{
+			Driver:           config.driver,
+			VolumeAttributes: config.volumeAttributes,
+		},
+	}
+	if config.fsType != "" {
+		volumeSource.CSI.FSType = &config.fsType
+	}
+	if config.nodePublishSecret != "" {
+		volumeSource.CSI.NodePublishSecretRef = &corev1.LocalObjectReference{Name: config.nodePublishSecret}
+	}
+	return volumeSource
+}
+
+// getCSIPersistentVolumeSource returns a csi volume source to be used in a static persistent volume. Its secret
+// is in the Velero namespace.
+func getCSIPersistentVolumeSource(namespace string, config volumeConfig) corev1.PersistentVolumeSource {
+	volumeSource := corev1.PersistentVolumeSource{
+		CSI: &corev1.CSIPersistentVolumeSource{
+			Driver:           config.driver,
+			VolumeHandle:     config.volumeHandle,
+			FSType:           config.fsType,
+			VolumeAttributes: config.volumeAttributes,
 		},
 	}
+	if config.nodePublishSecret != "" {
+		volumeSource.CSI.NodePublishSecretRef = &corev1.SecretReference{Name: config.nodePublishSecret, Namespace: namespace}
+	}
+	return volumeSource
+}
+
+// volumeName returns the name of the pod volume for a bucket of type vt. The name only depends on the type
+// and the bucket and is always a valid DNS-1123 label, so buckets that aren't, e.g. "hostPath-snapshots",
+// are lowercased and stripped of invalid characters. A hash of the type and bucket is added to names that were
+// changed or shortened that way, so that similar buckets don't end up with the same volume.
+func volumeName(vt VolumeType, bucket string) string {
+	name := string(vt) + "-" + bucket
+	sanitized := strings.Trim(invalidVolumeNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if sanitized == name && len(name) <= validation.DNS1123LabelMaxLength {
+		return name
+	}
 
-	return volumeSource, nil
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:4])
+	if max := validation.DNS1123LabelMaxLength - len(suffix); len(sanitized) > max {
+		sanitized = strings.TrimRight(sanitized[:max], "-")
+	}
+	return sanitized + suffix
 }
 
+var invalidVolumeNameChars = regexp.MustCompile("[^a-z0-9-]+")
+
 // buildVolumeMount creates a new k8s volume mount object
-func buildVolumeMount(bucket string, mountPath string) *corev1.VolumeMount {
-	return &corev1.VolumeMount{Name: bucket, MountPath: mountPath, ReadOnly: false}
+func buildVolumeMount(name string, mountPath string) *corev1.VolumeMount {
+	return &corev1.VolumeMount{Name: name, MountPath: mountPath, ReadOnly: false}
 }
 
 // hostPathTypePtr returns a pointer to a HostPathType constant
@@ -119,33 +208,34 @@ func hostPathTypePtr(v corev1.HostPathType) *corev1.HostPathType {
 	return &v
 }
 
-// ensurePVC creates a PVC based on the config present in the backupstoragelocation CRD
-func ensurePVC(config map[string]string, log *logrus.Entry) error {
-	namespace := os.Getenv("VELERO_NAMESPACE")
-
-	clientset, err := k8sutil.GetClientset()
-	if err != nil {
-		return errors.Wrap(err, "failed to get clientset")
+// ensurePVC creates a PVC based on the config present in the backupstoragelocation CRD, and returns its name.
+// The claim is named like the bucket's volume. Claims created by earlier versions of the plugin are named
+// after the bucket and are kept, since they hold the data.
+func ensurePVC(clientset kubernetes.Interface, namespace string, config volumeConfig, log *logrus.Entry) (string, error) {
+	if len(validation.IsDNS1123Subdomain(config.bucket)) == 0 {
+		pvcObj, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), config.bucket, metav1.GetOptions{})
+		if err != nil && !kuberneteserrors.IsNotFound(err) {
+			return "", errors.Wrap(err, "failed to get velero pvc")
+		}
+		if err == nil && pvcObj.Labels[VolumeProviderKey] == VolumeProviderLabel {
+			log.Infof("pvc already exists: %s", pvcObj.Name)
+			return pvcObj.Name, nil
+		}
 	}
 
-	pvcObj, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), config["bucket"], metav1.GetOptions{})
+	claimName := volumeName(config.volumeType, config.bucket)
+	pvcObj, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), claimName, metav1.GetOptions{})
 	if err != nil && !kuberneteserrors.IsNotFound(err) {
-		return errors.Wrap(err, "failed to get velero pvc")
+		return "", errors.Wrap(err, "failed to get velero pvc")
 	}
 	if err == nil {
 		log.Infof("pvc already exists: %s", pvcObj.Name)
-		return nil
+		return claimName, nil
 	}
 
-	var storageClassNamePtr *string
-	_, ok := config["storageClassName"]
-	if ok {
-		storageClassName := config["storageClassName"]
-		storageClassNamePtr = &storageClassName
-	}
 	persistentVolumeClaim := &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: config["bucket"],
+			Name: claimName,
 			Labels: map[string]string{
 				VolumeProviderKey: VolumeProviderLabel,
 			},
@@ -156,17 +246,120 @@ func ensurePVC(config map[string]string, log *logrus.Entry) error {
 			},
 			Resources: corev1.VolumeResourceRequirements{
 				Requests: corev1.ResourceList{
-					corev1.ResourceName(corev1.ResourceStorage): resource.MustParse(config["storageSize"]),
+					corev1.ResourceName(corev1.ResourceStorage): config.storageSize,
 				},
 			},
-			StorageClassName: storageClassNamePtr,
+			StorageClassName: config.storageClassName,
 		},
 	}
 
 	_, err = clientset.CoreV1().PersistentVolumeClaims(namespace).Create(context.TODO(), persistentVolumeClaim, metav1.CreateOptions{})
 	if err != nil {
-		return errors.Wrap(err, "failed to create velero pvc")
+		return "", errors.Wrap(err, "failed to create velero pvc")
 	}
 
+	return claimName, nil
+}
+
+// verifyExistingClaim returns an error unless the existing claim of a pvc volume is bound and can be mounted
+// by Velero, and by every node-agent pod at once if nodeAgent is set.
+func verifyExistingClaim(clientset kubernetes.Interface, namespace string, config volumeConfig, nodeAgent bool) error {
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), config.existingClaim, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get pvc %s", config.existingClaim)
+	}
+	if pvc.Status.Phase != corev1.ClaimBound {
+		return errors.Errorf("pvc %s is not bound, its phase is %q", pvc.Name, pvc.Status.Phase)
+	}
+	if slices.Contains(pvc.Status.AccessModes, corev1.ReadWriteMany) {
+		return nil
+	}
+	// The node-agent pods run on every node, while Velero on its own is a single pod
+	if nodeAgent {
+		return errors.Errorf("pvc %s must have the %s access mode to be mounted by the node-agent pods, got %v", pvc.Name, corev1.ReadWriteMany, pvc.Status.AccessModes)
+	}
+	if !slices.Contains(pvc.Status.AccessModes, corev1.ReadWriteOnce) {
+		return errors.Errorf("pvc %s must have the %s or %s access mode, got %v", pvc.Name, corev1.ReadWriteMany, corev1.ReadWriteOnce, pvc.Status.AccessModes)
+	}
 	return nil
 }
+
+// ensureStaticVolume creates a persistent volume with source and a claim bound to it for a bucket, based on the config
+// present in the backupstoragelocation CRD, and returns the name of the claim. The volume keeps the data once it is
+// released. Both are left as they are if they already exist, since the source of a persistent volume can't be changed.
+func ensureStaticVolume(clientset kubernetes.Interface, namespace string, config volumeConfig, source corev1.PersistentVolumeSource, log *logrus.Entry) (string, error) {
+	claimName := volumeName(config.volumeType, config.bucket)
+	// Persistent volumes are not namespaced, so the namespace keeps those of different Velero installs apart
+	volumeName := namespace + "-" + claimName
+	labels := map[string]string{
+		VolumeProviderKey: VolumeProviderLabel,
+		ManagedByKey:      ManagedByLabel,
+	}
+
+	pv, err := clientset.CoreV1().PersistentVolumes().Get(context.TODO(), volumeName, metav1.GetOptions{})
+	if err != nil && !kuberneteserrors.IsNotFound(err) {
+		return "", errors.Wrap(err, "failed to get velero pv")
+	}
+	if err == nil {
+		log.Infof("pv already exists: %s", pv.Name)
+		if !equality.Semantic.DeepEqual(pv.Spec.PersistentVolumeSource, source) || !equality.Semantic.DeepEqual(pv.Spec.MountOptions, config.mountOptions) {
+			log.Warnf("pv %s does not match the backup storage location config, delete it to create it again with the new config", pv.Name)
+		}
+	} else {
+		persistentVolume := &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   volumeName,
+				Labels: labels,
+			},
+			Spec: corev1.PersistentVolumeSpec{
+				Capacity: corev1.ResourceList{
+					corev1.ResourceStorage: config.storageSize,
+				},
+				PersistentVolumeSource:        source,
+				AccessModes:                   staticVolumeAccessModes(config),
+				PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+				MountOptions:                  config.mountOptions,
+				ClaimRef: &corev1.ObjectReference{
+					Namespace: namespace,
+					Name:      claimName,
+				},
+			},
+		}
+		if _, err := clientset.CoreV1().PersistentVolumes().Create(context.TODO(), persistentVolume, metav1.CreateOptions{}); err != nil {
+			return "", errors.Wrap(err, "failed to create velero pv")
+		}
+	}
+
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), claimName, metav1.GetOptions{})
+	if err != nil && !kuberneteserrors.IsNotFound(err) {
+		return "", errors.Wrap(err, "failed to get velero pvc")
+	}
+	if err == nil {
+		log.Infof("pvc already exists: %s", pvc.Name)
+		return claimName, nil
+	}
+
+	// An empty storage class keeps the claim from being provisioned dynamically
+	noStorageClass := ""
+	persistentVolumeClaim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   claimName,
+			Labels: labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: staticVolumeAccessModes(config),
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: config.storageSize,
+				},
+			},
+			StorageClassName: &noStorageClass,
+			VolumeName:       volumeName,
+		},
+	}
+	if _, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Create(context.TODO(), persistentVolumeClaim, metav1.CreateOptions{}); err != nil {
+		return "", errors.Wrap(err, "failed to create velero pvc")
+	}
+
+	return claimName, nil
+}
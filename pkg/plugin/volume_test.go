@@ -0,0 +1,418 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_volumeName(t *testing.T) {
+	tests := []struct {
+		name   string
+		vt     VolumeType
+		bucket string
+		want   string
+	}{
+		{name: "valid bucket", vt: Hostpath, bucket: "snapshots", want: "hostpath-snapshots"},
+		{name: "type tells buckets apart", vt: NFS, bucket: "snapshots", want: "nfs-snapshots"},
+		{name: "uppercase", vt: Hostpath, bucket: "hostPath-snapshots", want: "hostpath-hostpath-snapshots-34a3f58e"},
+		{name: "invalid characters", vt: PVC, bucket: "my_bucket.v2", want: "pvc-my-bucket-v2-33c971dc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := volumeName(tt.vt, tt.bucket)
+			require.Equal(t, tt.want, got)
+			require.Empty(t, validation.IsDNS1123Label(got))
+		})
+	}
+
+	long := volumeName(Hostpath, strings.Repeat("b", 100))
+	require.Empty(t, validation.IsDNS1123Label(long))
+	require.NotEqual(t, long, volumeName(Hostpath, strings.Repeat("b", 101)), "names of long buckets stay apart")
+	require.NotEqual(t, volumeName(Hostpath, "Snapshots"), volumeName(Hostpath, "snapshots"), "names of similar buckets stay apart")
+}
+
+func Test_ensureResources_VolumeNames(t *testing.T) {
+	hostPath := func(path string) corev1.VolumeSource {
+		return corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: path, Type: hostPathTypePtr(corev1.HostPathDirectory)}}
+	}
+	// The volume of the bucket was added by an earlier version of the plugin and is named after the bucket
+	clientset := fake.NewSimpleClientset(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "velero", Namespace: "velero"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:         "velero",
+							VolumeMounts: []corev1.VolumeMount{{Name: "Snapshots", MountPath: "/var/velero-local-volume-provider/Snapshots"}},
+						},
+						{
+							Name:         fileServerContainerName,
+							VolumeMounts: []corev1.VolumeMount{{Name: "Snapshots", MountPath: "/var/velero-local-volume-provider/Snapshots"}},
+						},
+					},
+					Volumes: []corev1.Volume{{Name: "Snapshots", VolumeSource: hostPath("/backups")}},
+				},
+			},
+		},
+	})
+	opts := func(bucket string, volume volumeConfig, preserveVolumes map[string]bool) EnsureResourcesOpts {
+		volume.bucket = bucket
+		return EnsureResourcesOpts{
+			clientset:  clientset,
+			namespace:  "velero",
+			bucket:     bucket,
+			path:       "/var/velero-local-volume-provider/" + bucket,
+			config:     &bslConfig{volume: volume},
+			pluginOpts: &localVolumeObjectStoreOpts{preserveVolumes: preserveVolumes},
+			volumeType: volume.volumeType,
+			log:        logrus.NewEntry(logrus.New()),
+		}
+	}
+	getDeployment := func() *appsv1.Deployment {
+		deployment, err := clientset.AppsV1().Deployments("velero").Get(context.TODO(), "velero", metav1.GetOptions{})
+		require.NoError(t, err)
+		return deployment
+	}
+	snapshots := volumeName(Hostpath, "Snapshots")
+
+	// The volume is renamed in place
+	require.NoError(t, ensureResources(opts("Snapshots", volumeConfig{volumeType: Hostpath, path: "/backups"}, nil)))
+	deployment := getDeployment()
+	require.Equal(t, `{"Snapshots":"`+snapshots+`"}`, deployment.Annotations[volumeNamesAnnotation])
+	spec := deployment.Spec.Template.Spec
+	require.Equal(t, []corev1.Volume{{Name: snapshots, VolumeSource: hostPath("/backups")}}, spec.Volumes)
+	for _, container := range spec.Containers {
+		require.Equal(t, []corev1.VolumeMount{{Name: snapshots, MountPath: "/var/velero-local-volume-provider/Snapshots"}}, container.VolumeMounts)
+	}
+
+	// Changing the type of the location replaces the volume of the bucket
+	require.NoError(t, ensureResources(opts("Snapshots", volumeConfig{volumeType: NFS, path: "/exports", server: "1.2.3.4"}, nil)))
+	deployment = getDeployment()
+	require.Equal(t, `{"Snapshots":"`+volumeName(NFS, "Snapshots")+`"}`, deployment.Annotations[volumeNamesAnnotation])
+	require.Len(t, deployment.Spec.Template.Spec.Volumes, 1)
+	require.Equal(t, volumeName(NFS, "Snapshots"), deployment.Spec.Template.Spec.Volumes[0].Name)
+
+	// preserveVolumes lists buckets rather than volumes
+	require.NoError(t, ensureResources(opts("other", volumeConfig{volumeType: Hostpath, path: "/other"}, map[string]bool{"Snapshots": true, "other": true})))
+	deployment = getDeployment()
+	require.Equal(t, `{"Snapshots":"`+volumeName(NFS, "Snapshots")+`","other":"hostpath-other"}`, deployment.Annotations[volumeNamesAnnotation])
+	require.Len(t, deployment.Spec.Template.Spec.Volumes, 2)
+
+	require.NoError(t, ensureResources(opts("other", volumeConfig{volumeType: Hostpath, path: "/other"}, map[string]bool{"other": true})))
+	deployment = getDeployment()
+	require.Equal(t, `{"other":"hostpath-other"}`, deployment.Annotations[volumeNamesAnnotation])
+	require.Equal(t, []corev1.Volume{{Name: "hostpath-other", VolumeSource: hostPath("/other")}}, deployment.Spec.Template.Spec.Volumes)
+}
+
+func Test_ensureResources_CSI(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "velero", Namespace: "velero"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "velero"}},
+				},
+			},
+		},
+	}
+	config := volumeConfig{
+		volumeType:        CSI,
+		bucket:            "snapshots",
+		storageSize:       defaultStaticVolumeSize,
+		driver:            "smb.csi.k8s.io",
+		volumeAttributes:  map[string]string{"source": "//fileserver/backups"},
+		nodePublishSecret: "smb-credentials",
+	}
+	ensure := func(config volumeConfig) *fake.Clientset {
+		clientset := fake.NewSimpleClientset(deployment.DeepCopy())
+		require.NoError(t, ensureResources(EnsureResourcesOpts{
+			clientset:  clientset,
+			namespace:  "velero",
+			bucket:     config.bucket,
+			path:       "/var/velero-local-volume-provider/" + config.bucket,
+			config:     &bslConfig{volume: config},
+			pluginOpts: &localVolumeObjectStoreOpts{},
+			volumeType: CSI,
+			log:        logrus.NewEntry(logrus.New()),
+		}))
+		return clientset
+	}
+	getVolumes := func(clientset *fake.Clientset) []corev1.Volume {
+		got, err := clientset.AppsV1().Deployments("velero").Get(context.TODO(), "velero", metav1.GetOptions{})
+		require.NoError(t, err)
+		return got.Spec.Template.Spec.Volumes
+	}
+
+	t.Run("inline", func(t *testing.T) {
+		clientset := ensure(config)
+		require.Equal(t, []corev1.Volume{{
+			Name: "csi-snapshots",
+			VolumeSource: corev1.VolumeSource{
+				CSI: &corev1.CSIVolumeSource{
+					Driver:               "smb.csi.k8s.io",
+					VolumeAttributes:     map[string]string{"source": "//fileserver/backups"},
+					NodePublishSecretRef: &corev1.LocalObjectReference{Name: "smb-credentials"},
+				},
+			},
+		}}, getVolumes(clientset))
+	})
+
+	t.Run("static", func(t *testing.T) {
+		static := config
+		static.volumeHandle = "fileserver/backups"
+		static.mountOptions = []string{"vers=3.0"}
+		clientset := ensure(static)
+		require.Equal(t, []corev1.Volume{{
+			Name: "csi-snapshots",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "csi-snapshots"},
+			},
+		}}, getVolumes(clientset))
+
+		pv, err := clientset.CoreV1().PersistentVolumes().Get(context.TODO(), "velero-csi-snapshots", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, &corev1.CSIPersistentVolumeSource{
+			Driver:               "smb.csi.k8s.io",
+			VolumeHandle:         "fileserver/backups",
+			VolumeAttributes:     map[string]string{"source": "//fileserver/backups"},
+			NodePublishSecretRef: &corev1.SecretReference{Name: "smb-credentials", Namespace: "velero"},
+		}, pv.Spec.CSI)
+		require.Equal(t, []string{"vers=3.0"}, pv.Spec.MountOptions)
+		require.Equal(t, corev1.PersistentVolumeReclaimRetain, pv.Spec.PersistentVolumeReclaimPolicy)
+		require.Equal(t, "csi-snapshots", pv.Spec.ClaimRef.Name)
+
+		pvc, err := clientset.CoreV1().PersistentVolumeClaims("velero").Get(context.TODO(), "csi-snapshots", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "velero-csi-snapshots", pvc.Spec.VolumeName)
+		require.Equal(t, "", *pvc.Spec.StorageClassName)
+	})
+}
+
+func Test_ensureResources_NFS(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "velero", Namespace: "velero"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "velero"}},
+				},
+			},
+		},
+	}
+	config := volumeConfig{
+		volumeType: NFS,
+		bucket:     "snapshots",
+		path:       "/exports/backups",
+		server:     "nfs.example.com",
+		readOnly:   true,
+	}
+	ensure := func(config volumeConfig) *fake.Clientset {
+		clientset := fake.NewSimpleClientset(deployment.DeepCopy())
+		require.NoError(t, ensureResources(EnsureResourcesOpts{
+			clientset:  clientset,
+			namespace:  "velero",
+			bucket:     config.bucket,
+			path:       "/var/velero-local-volume-provider/" + config.bucket,
+			config:     &bslConfig{volume: config},
+			pluginOpts: &localVolumeObjectStoreOpts{},
+			volumeType: NFS,
+			log:        logrus.NewEntry(logrus.New()),
+		}))
+		return clientset
+	}
+	getVolumes := func(clientset *fake.Clientset) []corev1.Volume {
+		got, err := clientset.AppsV1().Deployments("velero").Get(context.TODO(), "velero", metav1.GetOptions{})
+		require.NoError(t, err)
+		return got.Spec.Template.Spec.Volumes
+	}
+
+	t.Run("inline", func(t *testing.T) {
+		clientset := ensure(config)
+		require.Equal(t, []corev1.Volume{{
+			Name: "nfs-snapshots",
+			VolumeSource: corev1.VolumeSource{
+				NFS: &corev1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/backups", ReadOnly: true},
+			},
+		}}, getVolumes(clientset))
+
+		pvs, err := clientset.CoreV1().PersistentVolumes().List(context.TODO(), metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Empty(t, pvs.Items)
+	})
+
+	t.Run("persistent volume", func(t *testing.T) {
+		static := config
+		static.persistentVolume = true
+		static.storageSize = defaultStaticVolumeSize
+		static.mountOptions = []string{"hard", "nfsvers=4.1"}
+		clientset := ensure(static)
+		require.Equal(t, []corev1.Volume{{
+			Name: "nfs-snapshots",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "nfs-snapshots", ReadOnly: true},
+			},
+		}}, getVolumes(clientset))
+
+		labels := map[string]string{VolumeProviderKey: VolumeProviderLabel, ManagedByKey: ManagedByLabel}
+		pv, err := clientset.CoreV1().PersistentVolumes().Get(context.TODO(), "velero-nfs-snapshots", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, labels, pv.Labels)
+		require.Equal(t, &corev1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/backups", ReadOnly: true}, pv.Spec.NFS)
+		require.Equal(t, []string{"hard", "nfsvers=4.1"}, pv.Spec.MountOptions)
+		require.Equal(t, []corev1.PersistentVolumeAccessMode{corev1.ReadOnlyMany}, pv.Spec.AccessModes)
+		require.Equal(t, "nfs-snapshots", pv.Spec.ClaimRef.Name)
+
+		pvc, err := clientset.CoreV1().PersistentVolumeClaims("velero").Get(context.TODO(), "nfs-snapshots", metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, labels, pvc.Labels)
+		require.Equal(t, "velero-nfs-snapshots", pvc.Spec.VolumeName)
+		require.Equal(t, []corev1.PersistentVolumeAccessMode{corev1.ReadOnlyMany}, pvc.Spec.AccessModes)
+	})
+}
+
+func Test_ensureResources_ExistingClaim(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "velero", Namespace: "velero"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "velero"}},
+				},
+			},
+		},
+	}
+	claim := func(phase corev1.PersistentVolumeClaimPhase, mode corev1.PersistentVolumeAccessMode) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "backups", Namespace: "velero"},
+			Status:     corev1.PersistentVolumeClaimStatus{Phase: phase, AccessModes: []corev1.PersistentVolumeAccessMode{mode}},
+		}
+	}
+	nodeAgent := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: NodeAgentDaemonsetName, Namespace: "velero"},
+		Spec: appsv1.DaemonSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "node-agent"}},
+				},
+			},
+		},
+	}
+	tests := []struct {
+		name      string
+		claim     *corev1.PersistentVolumeClaim
+		nodeAgent bool
+		wantErr   string
+	}{
+		{name: "bound", claim: claim(corev1.ClaimBound, corev1.ReadWriteMany), nodeAgent: true},
+		{name: "missing", wantErr: "failed to get pvc backups"},
+		{name: "pending", claim: claim(corev1.ClaimPending, corev1.ReadWriteMany), wantErr: "pvc backups is not bound"},
+		{name: "single node without node-agent", claim: claim(corev1.ClaimBound, corev1.ReadWriteOnce)},
+		{
+			name:      "single node with node-agent",
+			claim:     claim(corev1.ClaimBound, corev1.ReadWriteOnce),
+			nodeAgent: true,
+			wantErr:   "pvc backups must have the ReadWriteMany access mode to be mounted by the node-agent pods",
+		},
+		{name: "read only", claim: claim(corev1.ClaimBound, corev1.ReadOnlyMany), wantErr: "pvc backups must have the ReadWriteMany or ReadWriteOnce access mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := []runtime.Object{deployment.DeepCopy()}
+			if tt.claim != nil {
+				objects = append(objects, tt.claim)
+			}
+			if tt.nodeAgent {
+				objects = append(objects, nodeAgent.DeepCopy())
+			}
+			clientset := fake.NewSimpleClientset(objects...)
+			err := ensureResources(EnsureResourcesOpts{
+				clientset:  clientset,
+				namespace:  "velero",
+				bucket:     "snapshots",
+				path:       "/var/velero-local-volume-provider/snapshots",
+				config:     &bslConfig{volume: volumeConfig{volumeType: PVC, bucket: "snapshots", existingClaim: "backups"}},
+				pluginOpts: &localVolumeObjectStoreOpts{},
+				volumeType: PVC,
+				log:        logrus.NewEntry(logrus.New()),
+			})
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			got, err := clientset.AppsV1().Deployments("velero").Get(context.TODO(), "velero", metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, []corev1.Volume{{
+				Name: "pvc-snapshots",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "backups"},
+				},
+			}}, got.Spec.Template.Spec.Volumes)
+
+			pvcs, err := clientset.CoreV1().PersistentVolumeClaims("velero").List(context.TODO(), metav1.ListOptions{})
+			require.NoError(t, err)
+			require.Len(t, pvcs.Items, 1, "no claim is created")
+		})
+	}
+}
+
+func Test_ensureResources_PVC(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "velero", Namespace: "velero"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "velero"}},
+				},
+			},
+		},
+	}
+	ensure := func(clientset *fake.Clientset, bucket string) string {
+		require.NoError(t, ensureResources(EnsureResourcesOpts{
+			clientset:  clientset,
+			namespace:  "velero",
+			bucket:     bucket,
+			path:       "/var/velero-local-volume-provider/" + bucket,
+			config:     &bslConfig{volume: volumeConfig{volumeType: PVC, bucket: bucket, storageSize: defaultStaticVolumeSize}},
+			pluginOpts: &localVolumeObjectStoreOpts{},
+			volumeType: PVC,
+			log:        logrus.NewEntry(logrus.New()),
+		}))
+		got, err := clientset.AppsV1().Deployments("velero").Get(context.TODO(), "velero", metav1.GetOptions{})
+		require.NoError(t, err)
+		volumes := got.Spec.Template.Spec.Volumes
+		require.Len(t, volumes, 1)
+		return volumes[0].PersistentVolumeClaim.ClaimName
+	}
+
+	t.Run("claims are named like the volume", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(deployment.DeepCopy())
+		claimName := ensure(clientset, "my_bucket.v2")
+		require.Equal(t, volumeName(PVC, "my_bucket.v2"), claimName)
+		require.Empty(t, validation.IsDNS1123Subdomain(claimName))
+		_, err := clientset.CoreV1().PersistentVolumeClaims("velero").Get(context.TODO(), claimName, metav1.GetOptions{})
+		require.NoError(t, err)
+	})
+
+	t.Run("claims named after the bucket are kept", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(deployment.DeepCopy(), &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "snapshots", Namespace: "velero", Labels: map[string]string{VolumeProviderKey: VolumeProviderLabel}},
+		})
+		require.Equal(t, "snapshots", ensure(clientset, "snapshots"))
+		pvcs, err := clientset.CoreV1().PersistentVolumeClaims("velero").List(context.TODO(), metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, pvcs.Items, 1)
+	})
+}